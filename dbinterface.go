@@ -13,6 +13,7 @@ import (
 	"github.com/jackc/pgx/v4"
 	"github.com/jlucasdba/pgstratify/queries"
 
+	"math"
 	"sort"
 	"strings"
 	"time"
@@ -26,6 +27,19 @@ const (
 	WaitModeNowait = 2
 )
 
+// constants defining what to do with tables that have never been analyzed (and so have no rowcount estimate)
+const (
+	NeverAnalyzedSkip     = 1 // leave them unmatched by any rule
+	NeverAnalyzedEstimate = 2 // estimate rowcount from the table's size
+	NeverAnalyzedAnalyze  = 3 // analyze them before evaluating rules
+)
+
+// constants defining how parameter changes are issued
+const (
+	AlterModeSeparate = 1
+	AlterModeCombined = 2
+)
+
 // shorthand for background context
 var bgctx = context.Background()
 
@@ -43,6 +57,14 @@ func (e AcquireLockError) Unwrap() error {
 	return e.Err
 }
 
+// constants classifying database errors by how we respond to them
+const (
+	ErrorClassFatal      = 1 // abort the run
+	ErrorClassRetriable  = 2 // try the table again
+	ErrorClassTable      = 3 // give up on this table, but carry on with the rest
+	ErrorClassConnection = 4 // reconnect, then try the table again
+)
+
 // Error indicating password authentication failure
 type PasswordAuthenticationError struct {
 	Err error
@@ -56,22 +78,45 @@ func (e PasswordAuthenticationError) Unwrap() error {
 	return e.Err
 }
 
+// Error indicating we connected to a hot standby, where there's nothing for us to do
+type StandbyError struct {
+	Host string
+}
+
+func (e StandbyError) Error() string {
+	return fmt.Sprintf("server %s is a hot standby", e.Host)
+}
+
+// settings for each session we open, so our sessions are identifiable and can't get stuck forever
+type SessionOptions struct {
+	ApplicationName         string
+	CatalogStatementTimeout time.Duration // statement_timeout for catalog transactions (0 for the server default)
+	CatalogIdleTimeout      time.Duration // idle_in_transaction_session_timeout for catalog transactions
+	AlterStatementTimeout   time.Duration // statement_timeout for alter (and analyze) transactions
+	AlterIdleTimeout        time.Duration // idle_in_transaction_session_timeout for alter (and analyze) transactions
+}
+
 // Struct wrapping a database connection.
 type DBInterface struct {
-	config *pgx.ConnConfig
-	conn   *pgx.Conn
+	config  *pgx.ConnConfig
+	conn    *pgx.Conn
+	session SessionOptions
 }
 
 // Construct a DBInterface from a ConnectOptions
-func NewDBInterface(connectoptions *ConnectOptions) (*DBInterface, error) {
-	i := DBInterface{}
+func NewDBInterface(connectoptions *ConnectOptions, session SessionOptions) (*DBInterface, error) {
+	i := DBInterface{session: session}
 	var err error
 
 	i.config, err = pgx.ParseConfig(connectoptions.BuildDSN())
 	if err != nil {
 		return nil, err
 	}
-	conn, err := pgx.ConnectConfig(bgctx, i.config)
+	// set at connect time, so it carries over when we reconnect
+	if session.ApplicationName != "" {
+		i.config.RuntimeParams["application_name"] = session.ApplicationName
+	}
+	conn, err := connectPrimary(i.config)
 	if err != nil {
 		var pgerr *pgconn.PgError
 		if errors.As(err, &pgerr) && pgerr.Code == pgerrcode.InvalidPassword {
@@ -83,9 +128,80 @@ func NewDBInterface(connectoptions *ConnectOptions) (*DBInterface, error) {
 	return &i, nil
 }
 
+/*
+	Connect, and make sure we didn't land on a hot standby. After a failover, a node that
+	used to be the primary may come back as a standby, and everything we do would fail
+	with a read-only transaction error.
+*/
+func connectPrimary(config *pgx.ConnConfig) (*pgx.Conn, error) {
+	conn, err := pgx.ConnectConfig(bgctx, config)
+	if err != nil {
+		return nil, err
+	}
+	var inrecovery bool
+	err = conn.QueryRow(bgctx, queries.InRecovery).Scan(&inrecovery)
+	if err != nil {
+		conn.Close(bgctx)
+		return nil, err
+	}
+	if inrecovery {
+		host := conn.PgConn().Conn().RemoteAddr().String()
+		conn.Close(bgctx)
+		return nil, &StandbyError{Host: host}
+	}
+	return conn, nil
+}
+
+// reconnect after the connection was lost, reusing the original connection config
+func (i *DBInterface) Reconnect() error {
+	if i.conn != nil {
+		i.conn.Close(bgctx)
+	}
+	conn, err := connectPrimary(i.config)
+	if err != nil {
+		return err
+	}
+	i.conn = conn
+	return nil
+}
+
+// check the connection is still alive
+func (i *DBInterface) Ping() error {
+	return i.conn.Ping(bgctx)
+}
+
+// decide how to respond to an error that occurred on this connection
+func (i *DBInterface) ClassifyError(err error) int {
+	// a recorded change that no longer applies, found once the table was locked - refusing means stopping, as it does before the run
+	var rcerr *ReconcileError
+	if errors.As(err, &rcerr) {
+		return ErrorClassFatal
+	}
+	var pgerr *pgconn.PgError
+	if errors.As(err, &pgerr) {
+		switch {
+		case pgerr.Code == pgerrcode.DeadlockDetected, pgerr.Code == pgerrcode.SerializationFailure:
+			return ErrorClassRetriable
+		case pgerr.Code == pgerrcode.InsufficientPrivilege, pgerr.Code == pgerrcode.UndefinedObject, pgerr.Code == pgerrcode.UndefinedTable, pgerr.Code == pgerrcode.QueryCanceled:
+			return ErrorClassTable
+		case pgerrcode.IsConnectionException(pgerr.Code), pgerr.Code == pgerrcode.AdminShutdown, pgerr.Code == pgerrcode.CrashShutdown, pgerr.Code == pgerrcode.CannotConnectNow:
+			return ErrorClassConnection
+		}
+		return ErrorClassFatal
+	}
+	// anything else that left us without a working connection was a connection loss
+	if i.conn != nil && i.conn.IsClosed() {
+		return ErrorClassConnection
+	}
+	return ErrorClassFatal
+}
+
 // close DBInterface (closes database connection)
+// zero DBInterfaces (used for dry-run) have no connection to close
 func (i *DBInterface) Close() {
-	i.conn.Close(bgctx)
+	if i.conn != nil {
+		i.conn.Close(bgctx)
+	}
 }
 
 // get current database name from the server
@@ -106,8 +222,332 @@ func (i *DBInterface) CurrentDB() string {
 	return dbname
 }
 
+/*
+	Check a config file before using it, at startup and when the daemon reloads it. Every
+	matchgroup's ruleset has to exist (an empty ruleset deliberately applies nothing, so it
+	doesn't have to), and drift policies other than revert need the history
+	(history says whether there is one). The database has to accept every regular expression
+	and size - we can't check these in Go, because postgres regular expressions are a
+	different dialect.
+*/
+func (i *DBInterface) ValidateConfig(config *ConfigFile, history bool) error {
+	for idx, val := range config.Matchgroups {
+		if _, ok := config.Rulesets[val.Ruleset]; !ok && val.Ruleset != "" {
+			return fmt.Errorf("matchgroup %d uses undefined ruleset `%s`", idx+1, val.Ruleset)
+		}
+	}
+	if config.NeedsHistory() && !history {
+		return errors.New("drift policies other than revert require history-schema")
+	}
+	for idx, val := range config.Matchgroups {
+		for _, re := range []struct{ name, re string }{{"schema", val.Schema}, {"table", val.Table}, {"owner", val.Owner}} {
+			var matched bool
+			err := i.conn.QueryRow(bgctx, queries.ValidateRegex, re.re).Scan(&matched)
+			if err != nil {
+				return fmt.Errorf("matchgroup %d has invalid %s regular expression `%s`: %w", idx+1, re.name, re.re, err)
+			}
+		}
+		var size int64
+		err := i.conn.QueryRow(bgctx, queries.ValidateSize, val.ExactCountMaxSize).Scan(&size)
+		if err != nil {
+			return fmt.Errorf("matchgroup %d has invalid exact_count_max_size `%s`: %w", idx+1, val.ExactCountMaxSize, err)
+		}
+	}
+	return nil
+}
+
+// check that the database accepts a size, as used in an option
+func (i *DBInterface) ValidateSize(option string, size string) error {
+	var bytes int64
+	err := i.conn.QueryRow(bgctx, queries.ValidateSize, size).Scan(&bytes)
+	if err != nil {
+		return fmt.Errorf("invalid %s value `%s`: %w", option, size, err)
+	}
+	return nil
+}
+
+// take a session-level advisory lock identified by class id and name
+// without wait, returns false if someone else holds the lock
+func (i *DBInterface) AdvisoryLock(ctx context.Context, classid int32, name string, wait bool) (bool, error) {
+	var acquired bool
+	var err error
+	if wait {
+		// pg_advisory_lock returns void, so the query just tells us we got it
+		err = i.conn.QueryRow(ctx, queries.RunLockWait, classid, name).Scan(&acquired)
+	} else {
+		err = i.conn.QueryRow(ctx, queries.RunLockTry, classid, name).Scan(&acquired)
+	}
+	if err != nil {
+		return false, err
+	}
+	return acquired, nil
+}
+
+// release a session-level advisory lock taken with AdvisoryLock
+func (i *DBInterface) AdvisoryUnlock(classid int32, name string) error {
+	var released bool
+	err := i.conn.QueryRow(bgctx, queries.RunLockRelease, classid, name).Scan(&released)
+	if err != nil {
+		return err
+	}
+	if !released {
+		return fmt.Errorf("advisory lock %d/%s was not held", classid, name)
+	}
+	return nil
+}
+
+/*
+	Build the temp table of relations matched by each matchgroup, within the given
+	transaction. Each relation only appears once, under the first matchgroup it matched.
+*/
+func buildTablesTempTab(tx pgx.Tx, matchconfig []ConfigMatchgroup) error {
+	type Matchgroup struct {
+		SchemaRE          string `json:"schemare"`
+		TableRE           string `json:"tablere"`
+		OwnerRE           string `json:"ownerre"`
+		CaseSensitive     bool   `json:"case_sensitive"`
+		Ruleset           string `json:"ruleset"`
+		RowcountSource    string `json:"rowcount_source"`
+		ExactCountMaxSize string `json:"exact_count_max_size"`
+	}
+
+	matchgroupsfordb := make([]Matchgroup, 0, len(matchconfig))
+	for _, val := range matchconfig {
+		matchgroupsfordb = append(matchgroupsfordb, Matchgroup{SchemaRE: val.Schema, TableRE: val.Table, OwnerRE: val.Owner, CaseSensitive: val.CaseSensitive, Ruleset: val.Ruleset, RowcountSource: val.RowcountSource, ExactCountMaxSize: val.ExactCountMaxSize})
+	}
+	buf, err := json.Marshal(matchgroupsfordb)
+	if err != nil {
+		return err
+	}
+
+	var b pgx.Batch
+
+	b.Queue(queries.TablesTempTab, string(buf))
+	b.Queue(queries.TablesTempTabPK)
+	b.Queue(`analyze pg_temp.tables`)
+
+	bresult := tx.SendBatch(bgctx, &b)
+	for i := 0; i < b.Len(); i++ {
+		_, err := bresult.Exec()
+		if err != nil {
+			bresult.Close()
+			return err
+		}
+	}
+	return bresult.Close()
+}
+
+/*
+	Set statement and idle-in-transaction timeouts for the rest of a transaction.
+	Zero leaves the server's setting alone.
+*/
+func setLocalTimeouts(tx pgx.Tx, statement time.Duration, idle time.Duration) error {
+	if statement > 0 {
+		_, err := tx.Exec(bgctx, fmt.Sprintf("set local statement_timeout = %d", statement.Milliseconds()), pgx.QuerySimpleProtocol(true))
+		if err != nil {
+			return err
+		}
+	}
+	if idle > 0 {
+		_, err := tx.Exec(bgctx, fmt.Sprintf("set local idle_in_transaction_session_timeout = %d", idle.Milliseconds()), pgx.QuerySimpleProtocol(true))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// a relation matched by a matchgroup, with its analyze statistics
+type MatchedRelation struct {
+	Reloid          int
+	QuotedFullName  string
+	Reltuples       float64
+	NeverAnalyzed   bool
+	ModSinceAnalyze int64
+	LastAnalyze     *time.Time // most recent manual or auto analyze, nil if never
+}
+
+/*
+	Whether a relation's statistics are out of date - either more than modrows rows have been
+	modified since the last analyze, or the last analyze is older than maxage. Zero disables
+	either check. A relation with no recorded analyze time is stale by age.
+*/
+func (rel MatchedRelation) IsStale(modrows int64, maxage time.Duration) bool {
+	if modrows > 0 && rel.ModSinceAnalyze > modrows {
+		return true
+	}
+	if maxage > 0 && (rel.LastAnalyze == nil || time.Since(*rel.LastAnalyze) > maxage) {
+		return true
+	}
+	return false
+}
+
+// get every relation matched by the given matchgroups, whether or not it needs changes
+func (i *DBInterface) GetMatchedRelations(matchconfig []ConfigMatchgroup) ([]MatchedRelation, error) {
+	tx, err := i.conn.BeginTx(bgctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadWrite, DeferrableMode: pgx.NotDeferrable})
+	if err != nil {
+		return nil, err
+	}
+	// only temp tables are written, so rollback is fine
+	defer func() {
+		err := tx.Rollback(bgctx)
+		if err != nil && !i.conn.IsClosed() {
+			log.Fatal(err)
+		}
+	}()
+
+	err = setLocalTimeouts(tx, i.session.CatalogStatementTimeout, i.session.CatalogIdleTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	err = buildTablesTempTab(tx, matchconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	rels := make([]MatchedRelation, 0)
+	r, _ := tx.Query(bgctx, queries.MatchedRelationsQuery)
+	for r.Next() {
+		var rel MatchedRelation
+		err := r.Scan(&rel.Reloid, &rel.QuotedFullName, &rel.Reltuples, &rel.NeverAnalyzed, &rel.ModSinceAnalyze, &rel.LastAnalyze)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		rels = append(rels, rel)
+	}
+	if r.Err() != nil {
+		return nil, r.Err()
+	}
+	return rels, nil
+}
+
+/*
+	Get the tables and materialized views no matchgroup covers, at least minsize (in any
+	format pg_size_bytes accepts) in size. They're returned as TableMatches with no
+	matchgroup (number 0) and no parameters, so they can go through the display-matches
+	report like any other.
+*/
+func (i *DBInterface) GetUnmatchedTables(matchconfig []ConfigMatchgroup, minsize string) ([]TableMatch, error) {
+	tx, err := i.conn.BeginTx(bgctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadWrite, DeferrableMode: pgx.NotDeferrable})
+	if err != nil {
+		return nil, err
+	}
+	// only temp tables are written, so rollback is fine
+	defer func() {
+		err := tx.Rollback(bgctx)
+		if err != nil && !i.conn.IsClosed() {
+			log.Fatal(err)
+		}
+	}()
+
+	err = setLocalTimeouts(tx, i.session.CatalogStatementTimeout, i.session.CatalogIdleTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	err = buildTablesTempTab(tx, matchconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	tms := make([]TableMatch, 0)
+	r, _ := tx.Query(bgctx, queries.UnmatchedTablesQuery, minsize)
+	for r.Next() {
+		tm := TableMatch{Matchgroup: new(ConfigMatchgroup), RowcountSource: "reltuples", Parameters: make(map[string]TableMatchParameter)}
+		err := r.Scan(&tm.Reloid, &tm.Relkind, &tm.QuotedFullName, &tm.Schema, &tm.Owner, &tm.Reltuples, &tm.Relsize, &tm.Reloptions, &tm.LastAutovacuum)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		tms = append(tms, tm)
+	}
+	if r.Err() != nil {
+		return nil, r.Err()
+	}
+	return tms, nil
+}
+
+// a relation's current storage parameters, nil for parameters that aren't set
+type RelationParameters struct {
+	QuotedFullName string
+	Relkind        rune
+	Reltuples      int
+	Parameters     map[string]*string
+}
+
+// look up the current storage parameters of the given relations - relations that no longer exist are left out
+func (i *DBInterface) GetRelationParameters(reloids []int) (map[int]RelationParameters, error) {
+	return queryRelationParameters(i.conn, reloids)
+}
+
+// does the work for GetRelationParameters, on a connection or (for UpdateTableParameters) a transaction
+func queryRelationParameters(q interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+}, reloids []int) (map[int]RelationParameters, error) {
+	rels := make(map[int]RelationParameters)
+	r, err := q.Query(bgctx, queries.RelationParametersQuery, reloids)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	for r.Next() {
+		var reloid int
+		var rel RelationParameters
+		var reltuples float64
+		var reloptions []string
+		err := r.Scan(&reloid, &rel.QuotedFullName, &rel.Relkind, &reltuples, &reloptions)
+		if err != nil {
+			return nil, err
+		}
+		// never-analyzed tables report -1
+		rel.Reltuples = int(math.Max(0, reltuples))
+		rel.Parameters = make(map[string]*string)
+		for _, val := range reloptions {
+			kv := strings.SplitN(val, "=", 2)
+			if len(kv) == 2 {
+				rel.Parameters[kv[0]] = &kv[1]
+			}
+		}
+		rels[reloid] = rel
+	}
+	return rels, r.Err()
+}
+
+// run analyze on a relation, giving up if we can't get the lock within timeout seconds (-1 to wait forever)
+func (i *DBInterface) AnalyzeRelation(rel MatchedRelation, timeout float64) error {
+	tx, err := i.conn.BeginTx(bgctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted, AccessMode: pgx.ReadWrite, DeferrableMode: pgx.NotDeferrable})
+	if err != nil {
+		return err
+	}
+	err = setLocalTimeouts(tx, i.session.AlterStatementTimeout, i.session.AlterIdleTimeout)
+	if err != nil {
+		tx.Rollback(bgctx)
+		return err
+	}
+	if timeout > 0 {
+		_, err = tx.Exec(bgctx, fmt.Sprintf("set local lock_timeout = %d", int64(math.Max(1, math.Round(timeout*1000)))), pgx.QuerySimpleProtocol(true))
+		if err != nil {
+			tx.Rollback(bgctx)
+			return err
+		}
+	}
+	_, err = tx.Exec(bgctx, fmt.Sprintf("analyze %s", rel.QuotedFullName), pgx.QuerySimpleProtocol(true))
+	if err != nil {
+		tx.Rollback(bgctx)
+		var pgerr *pgconn.PgError
+		if errors.As(err, &pgerr) && pgerr.Code == pgerrcode.LockNotAvailable {
+			return &AcquireLockError{fmt.Sprintf("Unable to acquire lock on %s for analyze (wait timed out)", rel.QuotedFullName), err}
+		}
+		return err
+	}
+	return tx.Commit(bgctx)
+}
+
 // given config matchgroups and rulesets, get all the matching tables in need of parameter update from the database
-func (i *DBInterface) GetTableMatches(matchconfig []ConfigMatchgroup, rulesetconfig map[string]ConfigRuleset, displaymode bool) ([]TableMatch, error) {
+// if evalstate is given, known relations that haven't changed are skipped, and evalstate is filled in with what was evaluated
+func (i *DBInterface) GetTableMatches(matchconfig []ConfigMatchgroup, rulesetconfig map[string]ConfigRuleset, displaymode bool, evalstate *EvaluationState, neveranalyzed int) ([]TableMatch, error) {
 	// define some structs for building json
 	type Rule struct {
 		Minrows  uint64             `json:"minrows"`
@@ -116,14 +556,6 @@ func (i *DBInterface) GetTableMatches(matchconfig []ConfigMatchgroup, rulesetcon
 
 	type Ruleset []Rule
 
-	type Matchgroup struct {
-		SchemaRE      string `json:"schemare"`
-		TableRE       string `json:"tablere"`
-		OwnerRE       string `json:"ownerre"`
-		CaseSensitive bool   `json:"case_sensitive"`
-		Ruleset       string `json:"ruleset"`
-	}
-
 	// define struct for parsing json from db
 	type Setting struct {
 		OldSetting *string `json:"oldsetting"`
@@ -134,10 +566,6 @@ func (i *DBInterface) GetTableMatches(matchconfig []ConfigMatchgroup, rulesetcon
 	tablematches := make([]TableMatch, 0)
 
 	// Build data structures to be dumped to json for query input
-	matchgroupsfordb := make([]Matchgroup, 0, len(matchconfig))
-	for _, val := range matchconfig {
-		matchgroupsfordb = append(matchgroupsfordb, Matchgroup{SchemaRE: val.Schema, TableRE: val.Table, OwnerRE: val.Owner, CaseSensitive: val.CaseSensitive, Ruleset: val.Ruleset})
-	}
 	rulesetsfordb := make(map[string]Ruleset, len(rulesetconfig))
 	for key, val := range rulesetconfig {
 		rulesetsfordb[key] = make(Ruleset, 0, len(val))
@@ -148,13 +576,7 @@ func (i *DBInterface) GetTableMatches(matchconfig []ConfigMatchgroup, rulesetcon
 			}
 		}
 	}
-	buf, err := json.Marshal(matchgroupsfordb)
-
-	if err != nil {
-		return nil, err
-	}
-	matchgroupsfordbjson := string(buf)
-	buf, err = json.Marshal(rulesetsfordb)
+	buf, err := json.Marshal(rulesetsfordb)
 	if err != nil {
 		return nil, err
 	}
@@ -181,37 +603,83 @@ func (i *DBInterface) GetTableMatches(matchconfig []ConfigMatchgroup, rulesetcon
 		return nil, err
 	}
 	// we don't need the temp tables after this transaction ends, and we're not writing, so rollback is fine
+	// if the connection was lost, the rollback fails too, but the caller gets the original error
 	defer func() {
 		err := tx.Rollback(bgctx)
-		if err != nil {
+		if err != nil && !i.conn.IsClosed() {
 			log.Fatal(err)
 		}
 	}()
 
+	err = setLocalTimeouts(tx, i.session.CatalogStatementTimeout, i.session.CatalogIdleTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	err = buildTablesTempTab(tx, matchconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// replace rowcounts for matchgroups that want them from somewhere other than pg_class.reltuples
+	_, err = tx.Exec(bgctx, queries.RowcountSourceUpdate)
+	if err != nil {
+		return nil, err
+	}
+
+	// tables that have never been analyzed have no rowcount estimate, so either make one or leave them unmatched
+	if neveranalyzed == NeverAnalyzedEstimate {
+		_, err = tx.Exec(bgctx, queries.NeverAnalyzedEstimateUpdate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	/*
-		Batch up the temp table creation statements for fewer roundtrips.
-		Unfortunately they can't be all in the same batch because SELECT
-		apparently can't reference tables created in the same batch.
-		But we batch up as many as we can.
+		In an incremental run, throw out the relations that haven't changed since we last
+		evaluated them, before doing any of the heavier work. Anything with the same rowcount
+		(both in pg_class, and from the matchgroup's rowcount source), relfilenode, owner, and
+		matchgroup would get the same answer as last time.
 	*/
-	var b pgx.Batch
+	if evalstate != nil && len(evalstate.Known) > 0 {
+		type KnownRelation struct {
+			Reloid         int     `json:"reloid"`
+			Reltuples      float64 `json:"reltuples"`
+			Rowcount       float64 `json:"rowcount"`
+			RowcountSource string  `json:"rowcountsource"`
+			Relfilenode    int64   `json:"relfilenode"`
+			Owner          string  `json:"owner"`
+			Matchgroup     int     `json:"matchgroup"`
+		}
+		known := make([]KnownRelation, 0, len(evalstate.Known))
+		for key, val := range evalstate.Known {
+			known = append(known, KnownRelation{Reloid: key, Reltuples: val.Reltuples, Rowcount: val.Rowcount, RowcountSource: val.RowcountSource, Relfilenode: val.Relfilenode, Owner: val.Owner, Matchgroup: val.Matchgroup})
+		}
+		buf, err := json.Marshal(known)
+		if err != nil {
+			return nil, err
+		}
 
-	b.Queue(queries.TablesTempTab, matchgroupsfordbjson)
-	b.Queue(queries.TablesTempTabPK)
-	b.Queue(`analyze pg_temp.tables`)
+		r, _ := tx.Query(bgctx, queries.UnchangedTablesDelete, string(buf))
+		for r.Next() {
+			var reloid int
+			err := r.Scan(&reloid)
+			if err != nil {
+				r.Close()
+				return nil, err
+			}
+			evalstate.Unchanged = append(evalstate.Unchanged, reloid)
+		}
+		if r.Err() != nil {
+			return nil, r.Err()
+		}
 
-	bresult := tx.SendBatch(bgctx, &b)
-	for i := 0; i < b.Len(); i++ {
-		_, err := bresult.Exec()
+		// stats from before the delete could be way off
+		_, err = tx.Exec(bgctx, `analyze pg_temp.tables`)
 		if err != nil {
-			bresult.Close()
 			return nil, err
 		}
 	}
-	err = bresult.Close()
-	if err != nil {
-		return nil, err
-	}
 
 	/*
 		No batch for this one because no accompanying statements.
@@ -223,7 +691,13 @@ func (i *DBInterface) GetTableMatches(matchconfig []ConfigMatchgroup, rulesetcon
 		return nil, err
 	}
 
-	b = *new(pgx.Batch)
+	/*
+		Batch up the temp table creation statements for fewer roundtrips.
+		Unfortunately they can't be all in the same batch because SELECT
+		apparently can't reference tables created in the same batch.
+		But we batch up as many as we can.
+	*/
+	var b pgx.Batch
 
 	b.Queue(queries.TableParametersTempTab)
 	b.Queue(queries.TableParametersTempTabPK)
@@ -234,7 +708,7 @@ func (i *DBInterface) GetTableMatches(matchconfig []ConfigMatchgroup, rulesetcon
 	b.Queue(queries.RulesetsSettingsTempTabPK)
 	b.Queue(`analyze pg_temp.rulesets, pg_temp.rulesets_settings`)
 
-	bresult = tx.SendBatch(bgctx, &b)
+	bresult := tx.SendBatch(bgctx, &b)
 	for i := 0; i < b.Len(); i++ {
 		_, err := bresult.Exec()
 		if err != nil {
@@ -263,8 +737,20 @@ func (i *DBInterface) GetTableMatches(matchconfig []ConfigMatchgroup, rulesetcon
 		var minrows *int
 		var jsonfromdb string
 		var matchgroupidx int
+		var relsize int64
+		var deadtuples int64
+		var xidage int
+		var tableneveranalyzed bool
+		var rowcountsource string
+		var schema string
+		var reloptions []string
+		var lastautovacuum *time.Time
 
-		err := r.Scan(&reloid, &relkind, &quotedfullname, &owner, &reltuples, &minrows, &jsonfromdb, &matchgroupidx)
+		dest := []interface{}{&reloid, &relkind, &quotedfullname, &owner, &reltuples, &minrows, &jsonfromdb, &matchgroupidx, &relsize, &deadtuples, &xidage, &tableneveranalyzed, &rowcountsource}
+		if displaymode {
+			dest = append(dest, &schema, &reloptions, &lastautovacuum)
+		}
+		err := r.Scan(dest...)
 		if err != nil {
 			r.Close()
 			return nil, err
@@ -280,15 +766,65 @@ func (i *DBInterface) GetTableMatches(matchconfig []ConfigMatchgroup, rulesetcon
 		for key, val := range options {
 			tmoptions[key] = TableMatchParameter(val)
 		}
-		tablematches = append(tablematches, TableMatch{Reloid: reloid, Relkind: relkind, QuotedFullName: quotedfullname, Owner: owner, Reltuples: reltuples, MatchgroupNum: matchgroupidx, Matchgroup: &matchconfig[matchgroupidx-1], Minrows: minrows, Parameters: tmoptions})
+		// only rowcounts that were actually estimated get marked - with other policies, never-analyzed tables just have no rowcount
+		tableneveranalyzed = tableneveranalyzed && neveranalyzed == NeverAnalyzedEstimate
+		tablematches = append(tablematches, TableMatch{Reloid: reloid, Relkind: relkind, QuotedFullName: quotedfullname, Owner: owner, Reltuples: reltuples, MatchgroupNum: matchgroupidx, Matchgroup: &matchconfig[matchgroupidx-1], Minrows: minrows, Parameters: tmoptions, Relsize: relsize, DeadTuples: deadtuples, XidAge: xidage, NeverAnalyzed: tableneveranalyzed, RowcountSource: rowcountsource, Schema: schema, Reloptions: reloptions, LastAutovacuum: lastautovacuum})
 	}
 	if r.Err() != nil {
 		return nil, r.Err()
 	}
 
+	// record everything we evaluated, so the next incremental run can skip it if nothing changes
+	if evalstate != nil {
+		evalstate.Evaluated = make(map[int]RelationState)
+		r, _ := tx.Query(bgctx, queries.EvaluatedTablesQuery)
+		for r.Next() {
+			var reloid int
+			var rs RelationState
+			err := r.Scan(&reloid, &rs.Reltuples, &rs.Rowcount, &rs.RowcountSource, &rs.Relfilenode, &rs.Owner, &rs.Matchgroup, &rs.Minrows)
+			if err != nil {
+				r.Close()
+				return nil, err
+			}
+			evalstate.Evaluated[reloid] = rs
+		}
+		if r.Err() != nil {
+			return nil, r.Err()
+		}
+	}
+
 	return tablematches, nil
 }
 
+// build a single alter statement setting or resetting the given parameters on this table
+func (tm *TableMatch) AlterSQL(params []string) (string, error) {
+	// string specifying if this is a table or materialized view
+	objecttype, err := tm.RelkindString()
+	if err != nil {
+		return *new(string), err
+	}
+	objecttype = strings.ToLower(objecttype)
+
+	sets := make([]string, 0, len(params))
+	resets := make([]string, 0, len(params))
+	for _, val := range params {
+		if tm.Parameters[val].NewSetting == nil {
+			resets = append(resets, pgx.Identifier{val}.Sanitize())
+		} else {
+			sets = append(sets, fmt.Sprintf("%s=%s", pgx.Identifier{val}.Sanitize(), pgx.Identifier{*tm.Parameters[val].NewSetting}.Sanitize()))
+		}
+	}
+
+	actions := make([]string, 0, 2)
+	if len(sets) > 0 {
+		actions = append(actions, fmt.Sprintf("set (%s)", strings.Join(sets, ", ")))
+	}
+	if len(resets) > 0 {
+		actions = append(actions, fmt.Sprintf("reset (%s)", strings.Join(resets, ", ")))
+	}
+	return fmt.Sprintf("alter %s %s %s", objecttype, tm.QuotedFullName, strings.Join(actions, ", ")), nil
+}
+
 // indicates whether setting a parameter was successful, and if not, why
 type UpdateTableParametersResultSettingSuccess struct {
 	Setting string
@@ -300,10 +836,14 @@ type UpdateTableParametersResultSettingSuccess struct {
 type UpdateTableParametersResult struct {
 	Match          TableMatch
 	SettingSuccess []UpdateTableParametersResultSettingSuccess
+	Attempts       int           // number of times we tried to lock the table, including this one
+	Worker         int           // index of the connection that made the last attempt, 0 being the main connection
+	LockWait       time.Duration // time spent in the alter statements, which is almost all waiting for locks
 }
 
 // given a TableMatch, try to update parameters on that table
-func (i *DBInterface) UpdateTableParameters(match TableMatch, dryrun bool, waitmode int, timeout float64) (UpdateTableParametersResult, error) {
+// if history is set, each change is recorded in the history schema, in the same transaction
+func (i *DBInterface) UpdateTableParameters(match TableMatch, dryrun bool, waitmode int, timeout float64, altermode int, history *HistoryTarget) (UpdateTableParametersResult, error) {
 	result := UpdateTableParametersResult{Match: match, SettingSuccess: make([]UpdateTableParametersResultSettingSuccess, 0, len(match.Parameters))}
 
 	// dryrun case is much shorter, so get it out of the way upfront
@@ -324,11 +864,29 @@ func (i *DBInterface) UpdateTableParameters(match TableMatch, dryrun bool, waitm
 		return result, err
 	}
 
+	/*
+		On any error other than failing to set a parameter, we give up on the table
+		entirely and let the caller decide what to do based on the error class.
+		If the connection is gone the rollback fails too, but that's not the
+		interesting error.
+	*/
+	abort := func(err error) (UpdateTableParametersResult, error) {
+		tx.Rollback(bgctx)
+		return UpdateTableParametersResult{Match: match, SettingSuccess: make([]UpdateTableParametersResultSettingSuccess, 0), LockWait: result.LockWait}, err
+	}
+
+	err = setLocalTimeouts(tx, i.session.AlterStatementTimeout, i.session.AlterIdleTimeout)
+	if err != nil {
+		return abort(err)
+	}
+
 	if waitmode == WaitModeNowait {
-		// we simulate nowait by setting lock_timeout to 1ms (0 means wait forever)
-		_, err = tx.Exec(bgctx, `set lock_timeout = 1`, pgx.QuerySimpleProtocol(true))
+		// we simulate nowait by setting a very short lock_timeout - at least 1ms (0 means wait forever)
+		// it's local, so a later wait-mode attempt on this connection doesn't inherit it
+		nowaitms := int64(math.Max(1, math.Round(timeout*1000)))
+		_, err = tx.Exec(bgctx, fmt.Sprintf("set local lock_timeout = %d", nowaitms), pgx.QuerySimpleProtocol(true))
 		if err != nil {
-			log.Fatal(err)
+			return abort(err)
 		}
 	}
 
@@ -346,63 +904,181 @@ func (i *DBInterface) UpdateTableParameters(match TableMatch, dryrun bool, waitm
 		deadline = time.Now().Add(timeoutduration)
 	}
 
-	// string specifying if this is a table or materialized view
-	objecttype, err := match.RelkindString()
-	if err != nil {
-		log.Fatal(err)
-	}
-	objecttype = strings.ToLower(objecttype)
-
-	// now we cycle through the table options and try to set each one
 	sortedkeys := make([]string, 0, len(match.Parameters))
 	for key := range match.Parameters {
 		sortedkeys = append(sortedkeys, key)
 	}
 	sort.Strings(sortedkeys)
-	for _, val := range sortedkeys {
-		var altersql string
-		if match.Parameters[val].NewSetting == nil {
-			altersql = fmt.Sprintf("alter %s %s reset (%s)", objecttype, match.QuotedFullName, pgx.Identifier{val}.Sanitize())
-		} else if match.Parameters[val].OldSetting == nil {
-			altersql = fmt.Sprintf("alter %s %s set (%s=%s)", objecttype, match.QuotedFullName, pgx.Identifier{val}.Sanitize(), pgx.Identifier{*match.Parameters[val].NewSetting}.Sanitize())
+
+	// in wait mode, set lock_timeout for the next alter to the time remaining until the deadline
+	setlocktimeout := func(tx2 pgx.Tx) error {
+		if waitmode != WaitModeWait || timeout <= 0 {
+			return nil
+		}
+		var err error
+		remaining := time.Until(deadline).Milliseconds()
+		if remaining > 0 {
+			_, err = tx2.Exec(bgctx, fmt.Sprintf("set local lock_timeout = %d", remaining), pgx.QuerySimpleProtocol(true))
 		} else {
-			altersql = fmt.Sprintf("alter %s %s set (%s=%s)", objecttype, match.QuotedFullName, pgx.Identifier{val}.Sanitize(), pgx.Identifier{*match.Parameters[val].NewSetting}.Sanitize())
+			// don't wait anymore - any further lock timeouts cause failure
+			_, err = tx2.Exec(bgctx, "set local lock_timeout = 1", pgx.QuerySimpleProtocol(true))
+		}
+		return err
+	}
+
+	// run a statement that locks the table, adding the time it took to LockWait - one that isn't blocked is quick
+	lockingexec := func(tx2 pgx.Tx, sql string) error {
+		start := time.Now()
+		_, err := tx2.Exec(bgctx, sql, pgx.QuerySimpleProtocol(true))
+		result.LockWait += time.Since(start)
+		return err
+	}
+
+	// if we fail to get a lock we fail the whole operation - rollback main transaction and return an empty result
+	lockfailure := func(err error) (UpdateTableParametersResult, error) {
+		if waitmode == WaitModeNowait {
+			// we were blocked in nowait mode
+			return abort(&AcquireLockError{fmt.Sprintf("Unable to acquire lock on %s", match.QuotedFullName), err})
+		}
+		// our timeout expired
+		return abort(&AcquireLockError{fmt.Sprintf("Unable to acquire lock on %s (wait timed out)", match.QuotedFullName), err})
+	}
+
+	/*
+		Alter failures are normally recorded against the parameter, but deadlocks,
+		serialization failures, and connection loss aren't the parameter's fault.
+		Those abort the table so it can be retried.
+	*/
+	abortsalter := func(err error) bool {
+		class := i.ClassifyError(err)
+		return class == ErrorClassRetriable || class == ErrorClassConnection
+	}
+
+	/*
+		Recorded changes (from a plan or undo file) were checked against the table before the
+		run started, but it could have changed since. Check again once nothing else can change
+		its parameters - changing storage parameters takes at least a share update exclusive
+		lock, so holding one keeps the check good until we commit. Materialized views can't be
+		locked explicitly, so for them the check is made in the same transaction, just before
+		the alters.
+	*/
+	if match.ReconcilePolicy != 0 {
+		var current map[int]RelationParameters
+		if match.Relkind == 'r' {
+			err = setlocktimeout(tx)
+			if err != nil {
+				return abort(err)
+			}
+			err = lockingexec(tx, fmt.Sprintf("lock table %s in share update exclusive mode", match.QuotedFullName))
+			if err != nil {
+				var pgerr *pgconn.PgError
+				if !errors.As(err, &pgerr) {
+					return abort(err)
+				}
+				switch pgerr.Code {
+				case pgerrcode.LockNotAvailable:
+					return lockfailure(err)
+				case pgerrcode.UndefinedTable:
+					// dropped since the run started, which the policy decides about, same as before the run
+					current = make(map[int]RelationParameters)
+				default:
+					return abort(err)
+				}
+			}
+		}
+		if current == nil {
+			current, err = queryRelationParameters(tx, []int{match.Reloid})
+			if err != nil {
+				return abort(err)
+			}
+		}
+		reconciled, err := ReconcileTableMatches([]TableMatch{match}, current, match.ReconcilePolicy)
+		if err != nil {
+			return abort(err)
+		}
+		if len(reconciled) == 0 {
+			// nothing left to change
+			tx.Rollback(bgctx)
+			return result, nil
+		}
+		match = reconciled[0]
+		result.Match = match
+		sortedkeys = match.SortedParameters()
+	}
+
+	/*
+		In combined mode, first try all the parameters in one statement, so we only
+		have to acquire the lock once. If that fails for any reason other than locking,
+		we fall back to setting them one at a time, so errors are attributed to the
+		right parameter.
+	*/
+	if altermode == AlterModeCombined && len(sortedkeys) > 1 {
+		altersql, err := match.AlterSQL(sortedkeys)
+		if err != nil {
+			return abort(err)
 		}
 		tx2, err := tx.Begin(bgctx)
 		if err != nil {
-			log.Fatal(err)
+			return abort(err)
+		}
+		err = setlocktimeout(tx2)
+		if err != nil {
+			return abort(err)
 		}
-		if waitmode == WaitModeWait && timeout > 0 {
-			remaining := time.Until(deadline).Milliseconds()
-			if remaining > 0 {
-				// lock_timeout for next alter is time remaining until deadline
-				_, err = tx2.Exec(bgctx, fmt.Sprintf("set lock_timeout = %d", remaining), pgx.QuerySimpleProtocol(true))
-			} else {
-				// don't wait anymore - any further lock timeouts cause failure
-				_, err = tx2.Exec(bgctx, "set lock_timeout = 1", pgx.QuerySimpleProtocol(true))
+		err = lockingexec(tx2, altersql)
+		if err != nil {
+			var pgerr *pgconn.PgError
+			if errors.As(err, &pgerr) && pgerr.Code == pgerrcode.LockNotAvailable {
+				return lockfailure(err)
 			}
+			if abortsalter(err) {
+				return abort(err)
+			}
+			rberr := tx2.Rollback(bgctx)
+			if rberr != nil {
+				return abort(rberr)
+			}
+			log.Debugf("Combined alter failed on %s, retrying parameters individually: %v", match.QuotedFullName, err)
+		} else {
+			err = tx2.Commit(bgctx)
 			if err != nil {
-				log.Fatal(err)
+				return abort(err)
 			}
+			for _, val := range sortedkeys {
+				if history != nil {
+					err = recordParameterChange(tx, history, &match, val)
+					if err != nil {
+						return abort(err)
+					}
+				}
+				result.SettingSuccess = append(result.SettingSuccess, UpdateTableParametersResultSettingSuccess{Setting: val, Success: true})
+			}
+			sortedkeys = nil
 		}
-		_, err = tx2.Exec(bgctx, altersql, pgx.QuerySimpleProtocol(true))
+	}
+
+	// now we cycle through the table options and try to set each one
+	for _, val := range sortedkeys {
+		altersql, err := match.AlterSQL([]string{val})
+		if err != nil {
+			return abort(err)
+		}
+		tx2, err := tx.Begin(bgctx)
+		if err != nil {
+			return abort(err)
+		}
+		err = setlocktimeout(tx2)
+		if err != nil {
+			return abort(err)
+		}
+		err = lockingexec(tx2, altersql)
 		if err != nil {
 			var pgerr *pgconn.PgError
 			if errors.As(err, &pgerr) && pgerr.Code == pgerrcode.LockNotAvailable {
-				// we fail the whole operation in this case - rollback main transaction
-				rberr := tx.Rollback(bgctx)
-				if rberr != nil {
-					log.Fatal(rberr)
-				}
-				// return an empty result
-				result := UpdateTableParametersResult{Match: match, SettingSuccess: make([]UpdateTableParametersResultSettingSuccess, 0)}
-				if waitmode == WaitModeNowait {
-					// we were blocked in nowait mode
-					return result, &AcquireLockError{fmt.Sprintf("Unable to acquire lock on %s", match.QuotedFullName), err}
-				} else {
-					// our timeout expired
-					return result, &AcquireLockError{fmt.Sprintf("Unable to acquire lock on %s (wait timed out)", match.QuotedFullName), err}
-				}
+				return lockfailure(err)
+			}
+			if abortsalter(err) {
+				return abort(err)
 			}
 
 			/*
@@ -411,14 +1087,20 @@ func (i *DBInterface) UpdateTableParameters(match TableMatch, dryrun bool, waitm
 			*/
 			rberr := tx2.Rollback(bgctx)
 			if rberr != nil {
-				log.Fatal(rberr)
+				return abort(rberr)
 			}
 			result.SettingSuccess = append(result.SettingSuccess, UpdateTableParametersResultSettingSuccess{Setting: val, Success: false, Err: err})
 		} else {
 			// we succeeded in setting the parameter, so release the savepoint
 			err = tx2.Commit(bgctx)
 			if err != nil {
-				log.Fatal(err)
+				return abort(err)
+			}
+			if history != nil {
+				err = recordParameterChange(tx, history, &match, val)
+				if err != nil {
+					return abort(err)
+				}
 			}
 			result.SettingSuccess = append(result.SettingSuccess, UpdateTableParametersResultSettingSuccess{Setting: val, Success: true})
 		}
@@ -426,11 +1108,21 @@ func (i *DBInterface) UpdateTableParameters(match TableMatch, dryrun bool, waitm
 
 	err = tx.Commit(bgctx)
 	if err != nil {
-		rberr := tx.Rollback(bgctx)
-		if rberr != nil {
-			log.Fatal(rberr)
-		}
-		return result, err
+		return abort(err)
 	}
 	return result, nil
 }
+
+// a result recording every parameter on the table as failed with the same error
+func TableFailureResult(match TableMatch, err error) UpdateTableParametersResult {
+	result := UpdateTableParametersResult{Match: match, SettingSuccess: make([]UpdateTableParametersResultSettingSuccess, 0, len(match.Parameters))}
+	sortedkeys := make([]string, 0, len(match.Parameters))
+	for key := range match.Parameters {
+		sortedkeys = append(sortedkeys, key)
+	}
+	sort.Strings(sortedkeys)
+	for _, val := range sortedkeys {
+		result.SettingSuccess = append(result.SettingSuccess, UpdateTableParametersResultSettingSuccess{Setting: val, Success: false, Err: err})
+	}
+	return result
+}
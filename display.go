@@ -0,0 +1,240 @@
+// Copyright (c) 2022 James Lucas
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// valid values for the --display-columns option
+var DisplayColumns = []string{"matchgroup", "ruleset", "type", "schema", "table", "owner", "rows", "rowcount-source", "minrows", "size", "reloptions", "settings", "changes", "last-autovacuum"}
+
+// columns used for a tabular match report when --display-columns isn't given
+var DefaultDisplayColumns = []string{"matchgroup", "ruleset", "type", "table", "owner", "rows", "minrows"}
+
+// columns used for the unmatched tables report when --display-columns isn't given
+var UnmatchedDisplayColumns = []string{"type", "table", "owner", "rows", "size", "reloptions"}
+
+// valid values for the --display-sort option
+var DisplaySorts = []string{"matchgroup", "name", "rows", "size", "last-autovacuum"}
+
+// parse a comma-separated list of display columns
+func ParseDisplayColumns(list string) ([]string, error) {
+	columns := make([]string, 0)
+	for _, val := range strings.Split(list, ",") {
+		col := strings.TrimSpace(val)
+		valid := false
+		for _, known := range DisplayColumns {
+			if col == known {
+				valid = true
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid display column `%s` (must be one of: %s)", col, strings.Join(DisplayColumns, ", "))
+		}
+		columns = append(columns, col)
+	}
+	return columns, nil
+}
+
+// which matches to show in display-matches mode - zero values don't filter
+type MatchFilter struct {
+	Matchgroups map[int]bool
+	Schemas     map[string]bool
+	MinRows     *int64 // nil for no minimum - never-analyzed tables show -1 rows, so even 0 would drop them
+	MaxRows     *int64 // nil for no maximum
+	PendingOnly bool
+}
+
+// the matches that pass the filter
+func (f *MatchFilter) Filter(tms []TableMatch) []TableMatch {
+	filtered := make([]TableMatch, 0, len(tms))
+	for _, val := range tms {
+		if len(f.Matchgroups) > 0 && !f.Matchgroups[val.MatchgroupNum] {
+			continue
+		}
+		if len(f.Schemas) > 0 && !f.Schemas[val.Schema] {
+			continue
+		}
+		if (f.MinRows != nil && int64(val.Reltuples) < *f.MinRows) || (f.MaxRows != nil && int64(val.Reltuples) > *f.MaxRows) {
+			continue
+		}
+		if f.PendingOnly && val.PendingChanges() == 0 {
+			continue
+		}
+		filtered = append(filtered, val)
+	}
+	return filtered
+}
+
+// how many parameters a run would actually change - in display mode, Parameters also holds those already set
+func (tm *TableMatch) PendingChanges() int {
+	count := 0
+	for _, val := range tm.Parameters {
+		if !settingsEqual(val.OldSetting, val.NewSetting) {
+			count++
+		}
+	}
+	return count
+}
+
+/*
+	Sort matches for display. Matchgroup order is matchgroup, then largest tables first,
+	then name. Other orders put the largest (or for last-autovacuum, the longest since,
+	with never first) at the top.
+*/
+func SortMatchDisplay(tms []TableMatch, order string) error {
+	var less func(a, b *TableMatch) bool
+	switch order {
+	case "matchgroup":
+		less = func(a, b *TableMatch) bool {
+			if a.MatchgroupNum == b.MatchgroupNum {
+				if a.Reltuples == b.Reltuples {
+					return a.QuotedFullName < b.QuotedFullName
+				}
+				return a.Reltuples > b.Reltuples
+			}
+			return a.MatchgroupNum < b.MatchgroupNum
+		}
+	case "name":
+		less = func(a, b *TableMatch) bool { return a.QuotedFullName < b.QuotedFullName }
+	case "rows":
+		less = func(a, b *TableMatch) bool { return a.Reltuples > b.Reltuples }
+	case "size":
+		less = func(a, b *TableMatch) bool { return a.Relsize > b.Relsize }
+	case "last-autovacuum":
+		less = func(a, b *TableMatch) bool {
+			if a.LastAutovacuum == nil || b.LastAutovacuum == nil {
+				return a.LastAutovacuum == nil && b.LastAutovacuum != nil
+			}
+			return a.LastAutovacuum.Before(*b.LastAutovacuum)
+		}
+	default:
+		return fmt.Errorf("invalid display-sort value `%s` (must be one of: %s)", order, strings.Join(DisplaySorts, ", "))
+	}
+	sort.SliceStable(tms, func(i, j int) bool { return less(&tms[i], &tms[j]) })
+	return nil
+}
+
+// a match's value for a display column, as text
+func (tm *TableMatch) DisplayValue(column string) string {
+	switch column {
+	case "matchgroup":
+		return strconv.Itoa(tm.MatchgroupNum)
+	case "ruleset":
+		return tm.Matchgroup.Ruleset
+	case "type":
+		return map[rune]string{'r': "table", 'm': "mview"}[tm.Relkind]
+	case "schema":
+		return tm.Schema
+	case "table":
+		return tm.QuotedFullName
+	case "owner":
+		return tm.Owner
+	case "rows":
+		return strconv.Itoa(tm.Reltuples)
+	case "rowcount-source":
+		if tm.NeverAnalyzed {
+			return tm.RowcountSource + " (estimated, never analyzed)"
+		}
+		return tm.RowcountSource
+	case "minrows":
+		if tm.Minrows == nil {
+			return ""
+		}
+		return strconv.Itoa(*tm.Minrows)
+	case "size":
+		return strconv.FormatInt(tm.Relsize, 10)
+	case "reloptions":
+		return strings.Join(tm.Reloptions, ",")
+	case "settings":
+		settings := make([]string, 0, len(tm.Parameters))
+		for _, key := range tm.SortedParameters() {
+			settings = append(settings, key+"="+settingString(tm.Parameters[key].NewSetting))
+		}
+		return strings.Join(settings, ",")
+	case "changes":
+		return strconv.Itoa(tm.PendingChanges())
+	case "last-autovacuum":
+		if tm.LastAutovacuum == nil {
+			return ""
+		}
+		return tm.LastAutovacuum.Format(time.RFC3339)
+	default:
+		return ""
+	}
+}
+
+// write a match report with a header row, as aligned text, csv, or tsv
+func WriteMatchTable(w io.Writer, tms []TableMatch, columns []string, format string) error {
+	var writerow func(row []string) error
+	var flush func() error
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		writerow = cw.Write
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	case "tsv":
+		// tsv has no quoting, so the separators can't appear in a value
+		clean := strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+		writerow = func(row []string) error {
+			for idx := range row {
+				row[idx] = clean.Replace(row[idx])
+			}
+			_, err := io.WriteString(w, strings.Join(row, "\t")+"\n")
+			return err
+		}
+		flush = func() error { return nil }
+	default:
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		writerow = func(row []string) error {
+			_, err := io.WriteString(tw, strings.Join(row, "\t")+"\n")
+			return err
+		}
+		flush = tw.Flush
+	}
+
+	header := make([]string, len(columns))
+	for idx, val := range columns {
+		header[idx] = strings.ToUpper(val)
+		if format == "csv" || format == "tsv" {
+			header[idx] = val
+		}
+	}
+	err := writerow(header)
+	if err != nil {
+		return err
+	}
+	for idx := range tms {
+		row := make([]string, len(columns))
+		for cidx, col := range columns {
+			row[cidx] = tms[idx].DisplayValue(col)
+		}
+		err = writerow(row)
+		if err != nil {
+			return err
+		}
+	}
+	return flush()
+}
+
+// a size in bytes for messages, the way pg_size_pretty does it
+func prettySize(size int64) string {
+	units := []string{"bytes", "kB", "MB", "GB", "TB", "PB"}
+	idx := 0
+	for size >= 10*1024 && idx < len(units)-1 {
+		size = (size + 512) / 1024
+		idx++
+	}
+	return fmt.Sprintf("%d %s", size, units[idx])
+}
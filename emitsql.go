@@ -0,0 +1,96 @@
+// Copyright (c) 2022 James Lucas
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+	Write the statements UpdateTableParameters would run as a psql script, so the changes
+	can be reviewed before anything is applied. Each table gets its own transaction, so
+	a failure on one table (psql carries on by default) doesn't affect the others, and
+	ON_ERROR_ROLLBACK makes psql wrap each statement in a savepoint, so one bad parameter
+	doesn't take the rest of the table's parameters with it.
+	Comments give the rowcount and rule that led to the change, and each parameter's
+	old and new settings.
+*/
+func WriteSQLScript(w io.Writer, tms []TableMatch, dbname string, altermode int, locktimeout float64) error {
+	bw := bufio.NewWriter(w)
+
+	paramcount := 0
+	for _, val := range tms {
+		paramcount += len(val.Parameters)
+	}
+	fmt.Fprintf(bw, "-- pgstratify %s script for database %s, generated %s\n", Version, commentSafe(dbname), time.Now().Format(time.RFC3339))
+	fmt.Fprintf(bw, "-- %d objects, %d parameters\n", len(tms), paramcount)
+	fmt.Fprintln(bw, "\\set ON_ERROR_ROLLBACK on")
+
+	for idx := range tms {
+		tm := &tms[idx]
+		objecttype, err := tm.RelkindString()
+		if err != nil {
+			return err
+		}
+		params := tm.SortedParameters()
+
+		fmt.Fprintln(bw, "")
+		rule := "no matching minrows"
+		if tm.Minrows != nil {
+			rule = fmt.Sprintf(">= minrows %d", *tm.Minrows)
+		}
+		source := ""
+		if tm.RowcountSource != "reltuples" {
+			source = fmt.Sprintf(" from %s", tm.RowcountSource)
+		}
+		fmt.Fprintf(bw, "-- %s %s: %d rows%s (matchgroup %d, ruleset %s, %s)\n", objecttype, commentSafe(tm.QuotedFullName), tm.Reltuples, source, tm.MatchgroupNum, commentSafe(tm.Matchgroup.Ruleset), rule)
+		for _, val := range params {
+			fmt.Fprintf(bw, "--   %s: %s -> %s\n", commentSafe(val), commentSafe(settingString(tm.Parameters[val].OldSetting)), commentSafe(settingString(tm.Parameters[val].NewSetting)))
+		}
+
+		fmt.Fprintln(bw, "begin;")
+		fmt.Fprintf(bw, "set local lock_timeout = %d;\n", int64(math.Max(1, math.Round(locktimeout*1000))))
+		// same grouping as UpdateTableParameters - without its per-parameter fallback for combined alters
+		groups := [][]string{params}
+		if altermode != AlterModeCombined {
+			groups = make([][]string, 0, len(params))
+			for _, val := range params {
+				groups = append(groups, []string{val})
+			}
+		}
+		for _, val := range groups {
+			altersql, err := tm.AlterSQL(val)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(bw, "%s;\n", altersql)
+		}
+		fmt.Fprintln(bw, "commit;")
+	}
+	return bw.Flush()
+}
+
+// write the script to the named file
+func WriteSQLScriptFile(filename string, tms []TableMatch, dbname string, altermode int, locktimeout float64) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = WriteSQLScript(f, tms, dbname, altermode, locktimeout)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// make a string safe to put in an sql comment - a line break would end the comment early
+func commentSafe(s string) string {
+	return strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ").Replace(s)
+}
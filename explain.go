@@ -0,0 +1,225 @@
+// Copyright (c) 2022 James Lucas
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jlucasdba/pgstratify/queries"
+	log "github.com/sirupsen/logrus"
+)
+
+// how one matchgroup's regular expressions fared against a table
+type MatchgroupExplanation struct {
+	Num        int
+	Matchgroup *ConfigMatchgroup
+	Schema     bool
+	Table      bool
+	Owner      bool
+}
+
+// whether every regular expression matched
+func (me *MatchgroupExplanation) Matched() bool {
+	return me.Schema && me.Table && me.Owner
+}
+
+// everything that goes into the settings a table gets, for the explain command
+type TableExplanation struct {
+	Reloid         int
+	QuotedFullName string
+	Relkind        rune
+	Permanent      bool
+	Owner          string
+	Reloptions     map[string]string // current storage parameters
+	Matchgroups    []MatchgroupExplanation
+	Winner         int         // number of the matchgroup that applies, 0 for none
+	Match          *TableMatch // the table as a run would see it, nil if no matchgroup applies
+}
+
+/*
+	Work out how the rules apply to one table. Each matchgroup's regular expressions are
+	checked the same way a run checks them. The rowcount and effective settings come from
+	the same queries a run uses, restricted to this table by running them with a copy of
+	the winning matchgroup that only matches its exact name, so they can't disagree with
+	what a run would do.
+*/
+func (i *DBInterface) ExplainTable(name string, config *ConfigFile, neveranalyzed int) (*TableExplanation, error) {
+	te := TableExplanation{Reloptions: make(map[string]string)}
+	var relnamespace, relname string
+	var relkind string
+	var reloptions []string
+	err := i.conn.QueryRow(bgctx, queries.ExplainRelationQuery, name).Scan(&te.Reloid, &te.QuotedFullName, &relkind, &te.Permanent, &relnamespace, &relname, &te.Owner, &reloptions)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("relation %s does not exist", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	te.Relkind = rune(relkind[0])
+	for _, val := range reloptions {
+		idx := strings.Index(val, "=")
+		if idx < 0 {
+			continue
+		}
+		te.Reloptions[val[:idx]] = val[idx+1:]
+	}
+	if te.Relkind != 'r' && te.Relkind != 'm' {
+		return nil, fmt.Errorf("%s is not a table or materialized view", te.QuotedFullName)
+	}
+
+	for idx := range config.Matchgroups {
+		mg := &config.Matchgroups[idx]
+		me := MatchgroupExplanation{Num: idx + 1, Matchgroup: mg}
+		for _, val := range []struct {
+			value string
+			re    string
+			dest  *bool
+		}{{relnamespace, mg.Schema, &me.Schema}, {relname, mg.Table, &me.Table}, {te.Owner, mg.Owner, &me.Owner}} {
+			err = i.conn.QueryRow(bgctx, queries.ExplainRegexMatch, val.value, val.re, mg.CaseSensitive).Scan(val.dest)
+			if err != nil {
+				return nil, fmt.Errorf("matchgroup %d: %w", me.Num, err)
+			}
+		}
+		if te.Winner == 0 && te.Permanent && me.Matched() {
+			te.Winner = me.Num
+		}
+		te.Matchgroups = append(te.Matchgroups, me)
+	}
+	if te.Winner == 0 {
+		return &te, nil
+	}
+
+	narrowed := config.Matchgroups[te.Winner-1]
+	narrowed.Schema = "^" + regexp.QuoteMeta(relnamespace) + "$"
+	narrowed.Table = "^" + regexp.QuoteMeta(relname) + "$"
+	narrowed.Owner = ""
+	narrowed.CaseSensitive = true
+	tms, err := i.GetTableMatches([]ConfigMatchgroup{narrowed}, config.Rulesets, true, nil, neveranalyzed)
+	if err != nil {
+		return nil, err
+	}
+	for idx := range tms {
+		if tms[idx].Reloid == te.Reloid {
+			te.Match = &tms[idx]
+			te.Match.MatchgroupNum = te.Winner
+			te.Match.Matchgroup = &config.Matchgroups[te.Winner-1]
+		}
+	}
+	return &te, nil
+}
+
+// write out the explanation
+func (te *TableExplanation) Output(rulesets map[string]ConfigRuleset) {
+	objecttype := map[rune]string{'r': "Table", 'm': "Materialized View"}[te.Relkind]
+	log.Infof("%s %s (oid %d, owner %s)", objecttype, te.QuotedFullName, te.Reloid, te.Owner)
+	if len(te.Reloptions) == 0 {
+		log.Info("Current storage parameters: none")
+	} else {
+		current := make([]string, 0, len(te.Reloptions))
+		for key, val := range te.Reloptions {
+			current = append(current, key+"="+val)
+		}
+		sort.Strings(current)
+		log.Infof("Current storage parameters: %s", strings.Join(current, ", "))
+	}
+	if !te.Permanent {
+		log.Info("Temporary and unlogged relations are never matched")
+	}
+
+	matchstr := map[bool]string{true: "matched", false: "did not match"}
+	log.Info("")
+	log.Info("Matchgroups:")
+	for idx := range te.Matchgroups {
+		me := &te.Matchgroups[idx]
+		var outcome string
+		switch {
+		case me.Num == te.Winner:
+			outcome = "applies"
+		case !me.Matched():
+			outcome = "no match"
+		case !te.Permanent:
+			outcome = "matched, but not a permanent relation"
+		default:
+			outcome = fmt.Sprintf("matched, but matchgroup %d came first", te.Winner)
+		}
+		log.Infof(`  %d (ruleset %s): schema "%s" %s, table "%s" %s, owner "%s" %s - %s`, me.Num, me.Matchgroup.Ruleset, me.Matchgroup.Schema, matchstr[me.Schema], me.Matchgroup.Table, matchstr[me.Table], me.Matchgroup.Owner, matchstr[me.Owner], outcome)
+	}
+	if te.Winner == 0 || te.Match == nil {
+		log.Info("")
+		log.Info("No matchgroup applies, so pgstratify leaves this relation alone")
+		return
+	}
+
+	tm := te.Match
+	log.Info("")
+	rows := fmt.Sprintf("Rows: %d (from %s)", tm.Reltuples, tm.RowcountSource)
+	if tm.NeverAnalyzed {
+		rows += ", estimated from its size, never analyzed"
+	}
+	log.Info(rows)
+
+	// rulesets are checked at startup, so the only one missing is the empty one
+	ruleset, ok := rulesets[tm.Matchgroup.Ruleset]
+	if !ok {
+		log.Info("The matchgroup has no ruleset, so no settings apply")
+		return
+	}
+	rules := make([]ConfigRule, len(ruleset))
+	copy(rules, ruleset)
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Minrows < rules[j].Minrows })
+
+	// the highest applying rule setting each parameter is the one that counts
+	applies := func(rule *ConfigRule) bool {
+		return tm.Reltuples >= 0 && uint64(tm.Reltuples) >= rule.Minrows
+	}
+	effective := make(map[string]uint64)
+	for idx := range rules {
+		if applies(&rules[idx]) {
+			for key := range rules[idx].Settings {
+				effective[key] = rules[idx].Minrows
+			}
+		}
+	}
+
+	log.Infof("Ruleset %s:", tm.Matchgroup.Ruleset)
+	for idx := range rules {
+		rule := &rules[idx]
+		if !applies(rule) {
+			log.Infof("  minrows %d: does not apply", rule.Minrows)
+		} else {
+			log.Infof("  minrows %d: applies", rule.Minrows)
+		}
+		keys := make([]string, 0, len(rule.Settings))
+		for key := range rule.Settings {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			note := ""
+			if applies(rule) && effective[key] != rule.Minrows {
+				note = fmt.Sprintf(" (masked by minrows %d)", effective[key])
+			}
+			log.Infof("    %s: %s%s", key, settingString(rule.Settings[key]), note)
+		}
+	}
+
+	log.Info("")
+	if len(tm.Parameters) == 0 {
+		log.Info("Effective settings: none")
+		return
+	}
+	log.Info("Effective settings:")
+	for _, key := range tm.SortedParameters() {
+		param := tm.Parameters[key]
+		change := "no change"
+		if !settingsEqual(param.OldSetting, param.NewSetting) {
+			change = "would change"
+		}
+		log.Infof("  %s: %s (currently %s, %s)", key, settingString(param.NewSetting), settingString(param.OldSetting), change)
+	}
+}
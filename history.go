@@ -0,0 +1,226 @@
+// Copyright (c) 2022 James Lucas
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jlucasdba/pgstratify/queries"
+	log "github.com/sirupsen/logrus"
+)
+
+// where to record changes in the database, and the run they belong to
+type HistoryTarget struct {
+	Schema string
+	RunID  string
+}
+
+// fill in the quoted schema name in a history query template
+func historySQL(template string, schema string) string {
+	return fmt.Sprintf(template, pgx.Identifier{schema}.Sanitize())
+}
+
+/*
+	Create the history schema, or upgrade it to the current version. Returns the versions
+	before and after. Safe to run repeatedly, and concurrently - the version table is
+	locked while we work.
+*/
+func (i *DBInterface) InstallHistory(schema string) (int, int, error) {
+	tx, err := i.conn.BeginTx(bgctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted, AccessMode: pgx.ReadWrite, DeferrableMode: pgx.NotDeferrable})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback(bgctx)
+
+	for _, val := range []string{queries.HistorySchemaCreate, queries.HistoryVersionCreate, queries.HistoryVersionLock} {
+		_, err = tx.Exec(bgctx, historySQL(val, schema))
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	var version int
+	err = tx.QueryRow(bgctx, historySQL(queries.HistoryVersionQuery, schema)).Scan(&version)
+	if err != nil {
+		return 0, 0, err
+	}
+	if version > len(queries.HistoryMigrations) {
+		return version, version, fmt.Errorf("history schema %s is version %d, which is newer than this version of pgstratify supports (%d)", schema, version, len(queries.HistoryMigrations))
+	}
+	for _, val := range queries.HistoryMigrations[version:] {
+		_, err = tx.Exec(bgctx, historySQL(val, schema), pgx.QuerySimpleProtocol(true))
+		if err != nil {
+			return version, version, err
+		}
+	}
+	_, err = tx.Exec(bgctx, historySQL(queries.HistoryVersionUpdate, schema), len(queries.HistoryMigrations))
+	if err != nil {
+		return version, version, err
+	}
+	return version, len(queries.HistoryMigrations), tx.Commit(bgctx)
+}
+
+// make sure the history schema is installed and current, so we don't fail on every table
+func (i *DBInterface) CheckHistory(schema string) error {
+	quoted := pgx.Identifier{schema}.Sanitize()
+	var installed bool
+	err := i.conn.QueryRow(bgctx, queries.HistoryCheck, quoted+".schema_version", quoted+".parameter_history").Scan(&installed)
+	if err != nil {
+		return err
+	}
+	if !installed {
+		return fmt.Errorf("history schema %s is not installed (run pgstratify install-history)", schema)
+	}
+	var version int
+	err = i.conn.QueryRow(bgctx, historySQL(queries.HistoryVersionQuery, schema)).Scan(&version)
+	if err != nil {
+		return err
+	}
+	if version != len(queries.HistoryMigrations) {
+		return fmt.Errorf("history schema %s is version %d, but this version of pgstratify needs version %d (run pgstratify install-history)", schema, version, len(queries.HistoryMigrations))
+	}
+	return nil
+}
+
+// record a parameter change, in the same transaction as the alter that made it
+func recordParameterChange(tx pgx.Tx, h *HistoryTarget, match *TableMatch, param string) error {
+	var matchgroup *int
+	var ruleset *string
+	if match.MatchgroupNum > 0 {
+		matchgroup = &match.MatchgroupNum
+		ruleset = &match.Matchgroup.Ruleset
+	}
+	_, err := tx.Exec(bgctx, historySQL(queries.HistoryParameterInsert, h.Schema), h.RunID, match.Reloid, match.QuotedFullName, string(match.Relkind), match.Reltuples, matchgroup, ruleset, match.Minrows, param, match.Parameters[param].OldSetting, match.Parameters[param].NewSetting)
+	return err
+}
+
+// record the summary of a finished run
+func (i *DBInterface) RecordRun(h *HistoryTarget, started time.Time, mode string, rs *RunStats, exitcode int) error {
+	_, err := i.conn.Exec(bgctx, historySQL(queries.HistoryRunInsert, h.Schema), h.RunID, started, mode, rs.TablesMatched, rs.MViewsMatched, rs.ParametersMatched, rs.ParametersAttempted, rs.ParametersSet, rs.ParametersErrored, rs.TablesSkippedLocked, rs.ParametersDrifted, exitcode)
+	return err
+}
+
+/*
+	Check the changes we're about to make against what we last applied, according to the
+	history. A parameter has drifted if its current setting isn't the one we last applied,
+	meaning someone has changed it by hand since. What happens next is up to the drift
+	policy of the table's matchgroup:
+
+	  revert - report it, and change it anyway
+	  warn   - report it, and leave it alone
+	  adopt  - report it, leave it alone, and pin it so it's left alone from now on
+
+	Pinned parameters are always left alone, whatever the policy. Parameters we have never
+	applied can't have drifted. In a dry run (h is nil), nothing is pinned.
+
+	With resetmanaged, a parameter is only reset if its current setting was put there by
+	one of our rules - anything set by hand (including settings undo put back) is left
+	alone. Returns the changes still to make, and how many parameters had drifted.
+*/
+func (i *DBInterface) CheckDrift(schema string, h *HistoryTarget, tms []TableMatch, resetmanaged bool) ([]TableMatch, int, error) {
+	reloids := make([]int, 0, len(tms))
+	for _, val := range tms {
+		reloids = append(reloids, val.Reloid)
+	}
+
+	type paramKey struct {
+		reloid int
+		param  string
+	}
+	type appliedSetting struct {
+		setting  *string
+		fromrule bool // false if it was put back by undo
+	}
+	applied := make(map[paramKey]appliedSetting)
+	rows, err := i.conn.Query(bgctx, historySQL(queries.HistoryLastAppliedQuery, schema), reloids)
+	if err != nil {
+		return nil, 0, err
+	}
+	for rows.Next() {
+		var key paramKey
+		var val appliedSetting
+		err = rows.Scan(&key.reloid, &key.param, &val.setting, &val.fromrule)
+		if err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		applied[key] = val
+	}
+	if rows.Err() != nil {
+		return nil, 0, rows.Err()
+	}
+
+	pinned := make(map[paramKey]bool)
+	rows, err = i.conn.Query(bgctx, historySQL(queries.HistoryPinsQuery, schema), reloids)
+	if err != nil {
+		return nil, 0, err
+	}
+	for rows.Next() {
+		var key paramKey
+		err = rows.Scan(&key.reloid, &key.param)
+		if err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		pinned[key] = true
+	}
+	if rows.Err() != nil {
+		return nil, 0, rows.Err()
+	}
+
+	drifted := 0
+	result := make([]TableMatch, 0, len(tms))
+	for _, tm := range tms {
+		keep := make(map[string]TableMatchParameter, len(tm.Parameters))
+		for _, param := range tm.SortedParameters() {
+			val := tm.Parameters[param]
+			key := paramKey{reloid: tm.Reloid, param: param}
+			plog := log.WithFields(log.Fields{"table": tm.QuotedFullName, "parameter": param, "old": logSetting(val.OldSetting), "new": logSetting(val.NewSetting)})
+			if pinned[key] {
+				plog.Debugf("Parameter %s on %s is pinned, leaving it alone", param, tm.QuotedFullName)
+				continue
+			}
+			last, ok := applied[key]
+			unmanaged := resetmanaged && val.NewSetting == nil && !(ok && last.fromrule && settingsEqual(last.setting, val.OldSetting))
+			if !ok || settingsEqual(last.setting, val.OldSetting) {
+				if unmanaged {
+					plog.Debugf("Not resetting %s on %s (%s), it wasn't set by pgstratify", param, tm.QuotedFullName, settingString(val.OldSetting))
+					continue
+				}
+				keep[param] = val
+				continue
+			}
+
+			drifted++
+			msg := fmt.Sprintf("Parameter %s on %s was changed outside pgstratify (last applied %s, now %s)", param, tm.QuotedFullName, settingString(last.setting), settingString(val.OldSetting))
+			switch tm.Matchgroup.DriftPolicy {
+			case "warn":
+				plog.Warnf("%s, leaving it alone", msg)
+			case "adopt":
+				if h == nil {
+					plog.Warnf("%s, would adopt it as a pinned exception", msg)
+					continue
+				}
+				_, err = i.conn.Exec(bgctx, historySQL(queries.HistoryPinInsert, schema), tm.Reloid, param, tm.QuotedFullName, val.OldSetting, h.RunID)
+				if err != nil {
+					return nil, 0, err
+				}
+				plog.Warnf("%s, adopted it as a pinned exception", msg)
+			default:
+				if unmanaged {
+					plog.Warnf("%s, not resetting it", msg)
+					continue
+				}
+				plog.Warnf("%s, reverting it", msg)
+				keep[param] = val
+			}
+		}
+		if len(keep) > 0 {
+			tm.Parameters = keep
+			result = append(result, tm)
+		}
+	}
+	return result, drifted, nil
+}
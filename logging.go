@@ -0,0 +1,154 @@
+// Copyright (c) 2022 James Lucas
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// valid values for the --log-format option
+var LogFormats = []string{"text", "json", "logfmt"}
+
+// Define custom log formatter with very minimal output.
+// We're only really using log levels for verbosity - we
+// don't need fancy formatting.
+type PlainFormatter struct{}
+
+func (f *PlainFormatter) Format(entry *log.Entry) ([]byte, error) {
+	return []byte(entry.Message + "\n"), nil
+}
+
+/*
+	Writes every log entry to where it belongs. Logrus only has a single output, and
+	switching it per entry from a hook (as we used to) races when workers log at the
+	same time - one goroutine can switch the output while another is writing. Instead,
+	logrus's own output is discarded, and this hook formats and writes each entry
+	itself, holding its own lock so entries from concurrent workers never interleave.
+
+	Info, debug, and trace go to stdout, and warnings and worse to stderr. With a log
+	file, everything goes to the file instead, except that fatal errors are also
+	written to stderr, so a failed run is never silent.
+*/
+type LogRouter struct {
+	formatter log.Formatter
+	stdout    io.Writer
+	stderr    io.Writer
+	filename  string
+	file      *os.File
+	fields    log.Fields // added to every entry that doesn't have them already
+	mutex     sync.Mutex
+}
+
+// construct a LogRouter writing plain messages to stdout and stderr
+func NewLogRouter() *LogRouter {
+	return &LogRouter{formatter: new(PlainFormatter), stdout: os.Stdout, stderr: os.Stderr, fields: make(log.Fields)}
+}
+
+// install the router as the only writer of log entries
+func (lr *LogRouter) Install() {
+	log.SetFormatter(new(PlainFormatter))
+	log.SetOutput(io.Discard)
+	log.AddHook(lr)
+}
+
+// set the format entries are written in (text, json, or logfmt) - text is the message alone, without fields
+func (lr *LogRouter) SetFormat(format string) error {
+	var formatter log.Formatter
+	switch format {
+	case "text":
+		formatter = new(PlainFormatter)
+	case "json":
+		formatter = &log.JSONFormatter{}
+	case "logfmt":
+		formatter = &log.TextFormatter{DisableColors: true, FullTimestamp: true}
+	default:
+		return fmt.Errorf("invalid log-format value `%s`", format)
+	}
+	lr.mutex.Lock()
+	defer lr.mutex.Unlock()
+	lr.formatter = formatter
+	return nil
+}
+
+// send info, debug, and trace to w instead of stdout - used when stdout is reserved for structured output
+func (lr *LogRouter) SetStdout(w io.Writer) {
+	lr.mutex.Lock()
+	defer lr.mutex.Unlock()
+	lr.stdout = w
+}
+
+// add a field to every entry from now on
+func (lr *LogRouter) SetField(key string, value interface{}) {
+	lr.mutex.Lock()
+	defer lr.mutex.Unlock()
+	lr.fields[key] = value
+}
+
+// write everything to the named file from now on, appending to it if it exists
+func (lr *LogRouter) SetFile(filename string) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	lr.mutex.Lock()
+	defer lr.mutex.Unlock()
+	if lr.file != nil {
+		lr.file.Close()
+	}
+	lr.filename = filename
+	lr.file = f
+	return nil
+}
+
+// reopen the log file, so a rotated file gets replaced - does nothing without a log file
+func (lr *LogRouter) Reopen() error {
+	lr.mutex.Lock()
+	filename := lr.filename
+	lr.mutex.Unlock()
+	if filename == "" {
+		return nil
+	}
+	return lr.SetFile(filename)
+}
+
+func (lr *LogRouter) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (lr *LogRouter) Fire(e *log.Entry) error {
+	lr.mutex.Lock()
+	defer lr.mutex.Unlock()
+
+	// the entry's own fields take precedence
+	data := make(log.Fields, len(lr.fields)+len(e.Data))
+	for key, val := range lr.fields {
+		data[key] = val
+	}
+	for key, val := range e.Data {
+		data[key] = val
+	}
+	entry := &log.Entry{Logger: e.Logger, Data: data, Time: e.Time, Level: e.Level, Caller: e.Caller, Message: e.Message, Context: e.Context}
+	buf, err := lr.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+
+	if lr.file != nil {
+		if e.Level <= log.FatalLevel {
+			lr.stderr.Write(buf)
+		}
+		_, err = lr.file.Write(buf)
+		return err
+	}
+	if e.Level <= log.WarnLevel {
+		_, err = lr.stderr.Write(buf)
+	} else {
+		_, err = lr.stdout.Write(buf)
+	}
+	return err
+}
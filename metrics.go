@@ -0,0 +1,224 @@
+// Copyright (c) 2022 James Lucas
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upper bounds in seconds of the lock wait histogram buckets
+var lockWaitBuckets = []float64{0.001, 0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
+// a prometheus-style histogram, with cumulative bucket counts
+type histogram struct {
+	counts []uint64 // one per bucket in lockWaitBuckets
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(lockWaitBuckets))
+	}
+	for idx, val := range lockWaitBuckets {
+		if v <= val {
+			h.counts[idx]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// objects matched are counted by kind and matchgroup
+type objectKey struct {
+	Kind       string
+	Matchgroup int
+}
+
+/*
+	Metrics about runs, in prometheus text format. Gauges describe the most recent run,
+	while counters and histograms accumulate for the life of the process (which for a
+	one-shot run is just the one run). Written by hand rather than pulling in the
+	prometheus client, since there's so little of it.
+*/
+type Metrics struct {
+	database            string
+	runs                map[string]uint64 // by result - success or failure
+	lastDuration        float64
+	lastRun             time.Time
+	lastSuccess         time.Time
+	lastExitCode        int
+	objectsMatched      map[objectKey]int
+	parametersSet       int
+	parametersErrored   int
+	parametersSkipped   int
+	tablesSkippedLocked int
+	parametersDrifted   int
+	lockWait            map[string]*histogram // by wait mode
+	mutex               sync.Mutex
+}
+
+// construct an empty Metrics for the given database
+func NewMetrics(database string) *Metrics {
+	return &Metrics{database: database, runs: make(map[string]uint64), objectsMatched: make(map[objectKey]int), lockWait: make(map[string]*histogram)}
+}
+
+// record how long an attempt to update a table waited for locks - also accessed from goroutines
+func (m *Metrics) ObserveLockWait(waitmode int, d time.Duration) {
+	mode := map[int]string{WaitModeWait: "wait", WaitModeNowait: "nowait"}[waitmode]
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	h, ok := m.lockWait[mode]
+	if !ok {
+		h = new(histogram)
+		m.lockWait[mode] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// record a run that completed
+func (m *Metrics) RecordRun(tms []TableMatch, rs *RunStats, started time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	m.runs["success"]++
+	m.lastDuration = now.Sub(started).Seconds()
+	m.lastRun = now
+	m.lastSuccess = now
+	m.lastExitCode = rs.ExitCode(false)
+	m.objectsMatched = make(map[objectKey]int)
+	for _, val := range tms {
+		kind := map[rune]string{'r': "table", 'm': "mview"}[val.Relkind]
+		m.objectsMatched[objectKey{Kind: kind, Matchgroup: val.MatchgroupNum}]++
+	}
+	m.parametersSet = rs.ParametersSet
+	m.parametersErrored = rs.ParametersErrored
+	m.parametersSkipped = rs.ParametersMatched - rs.ParametersAttempted
+	m.tablesSkippedLocked = rs.TablesSkippedLocked
+	m.parametersDrifted = rs.ParametersDrifted
+}
+
+// record a run that was aborted - the counts from the last completed run are left alone
+func (m *Metrics) RecordFailure(started time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	m.runs["failure"]++
+	m.lastDuration = now.Sub(started).Seconds()
+	m.lastRun = now
+	m.lastExitCode = ExitFatal
+}
+
+// quote a label value
+func labelValue(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// write all metrics in prometheus text exposition format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var buf bytes.Buffer
+	db := "database=" + labelValue(m.database)
+	metric := func(name string, mtype string, help string) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, mtype)
+	}
+	float := func(v float64) string {
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+
+	metric("pgstratify_runs_total", "counter", "Number of runs, by result.")
+	for _, result := range []string{"success", "failure"} {
+		fmt.Fprintf(&buf, "pgstratify_runs_total{%s,result=%s} %d\n", db, labelValue(result), m.runs[result])
+	}
+
+	metric("pgstratify_last_run_duration_seconds", "gauge", "Duration of the most recent run.")
+	fmt.Fprintf(&buf, "pgstratify_last_run_duration_seconds{%s} %s\n", db, float(m.lastDuration))
+
+	metric("pgstratify_last_run_timestamp_seconds", "gauge", "Time the most recent run finished.")
+	fmt.Fprintf(&buf, "pgstratify_last_run_timestamp_seconds{%s} %d\n", db, unixOrZero(m.lastRun))
+
+	metric("pgstratify_last_success_timestamp_seconds", "gauge", "Time the most recent run that wasn't aborted finished.")
+	fmt.Fprintf(&buf, "pgstratify_last_success_timestamp_seconds{%s} %d\n", db, unixOrZero(m.lastSuccess))
+
+	metric("pgstratify_last_run_exit_code", "gauge", "Detailed exit code of the most recent run.")
+	fmt.Fprintf(&buf, "pgstratify_last_run_exit_code{%s} %d\n", db, m.lastExitCode)
+
+	metric("pgstratify_objects_matched", "gauge", "Objects needing changes in the most recent run, by kind and matchgroup.")
+	keys := make([]objectKey, 0, len(m.objectsMatched))
+	for key := range m.objectsMatched {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Matchgroup == keys[j].Matchgroup {
+			return keys[i].Kind < keys[j].Kind
+		}
+		return keys[i].Matchgroup < keys[j].Matchgroup
+	})
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "pgstratify_objects_matched{%s,kind=%s,matchgroup=\"%d\"} %d\n", db, labelValue(key.Kind), key.Matchgroup, m.objectsMatched[key])
+	}
+
+	metric("pgstratify_parameters", "gauge", "Parameters in the most recent run, by outcome.")
+	fmt.Fprintf(&buf, "pgstratify_parameters{%s,outcome=\"set\"} %d\n", db, m.parametersSet)
+	fmt.Fprintf(&buf, "pgstratify_parameters{%s,outcome=\"errored\"} %d\n", db, m.parametersErrored)
+	fmt.Fprintf(&buf, "pgstratify_parameters{%s,outcome=\"skipped\"} %d\n", db, m.parametersSkipped)
+
+	metric("pgstratify_tables_skipped_locked", "gauge", "Objects skipped in the most recent run because they couldn't be locked.")
+	fmt.Fprintf(&buf, "pgstratify_tables_skipped_locked{%s} %d\n", db, m.tablesSkippedLocked)
+
+	metric("pgstratify_parameters_drifted", "gauge", "Parameters found changed outside pgstratify in the most recent run.")
+	fmt.Fprintf(&buf, "pgstratify_parameters_drifted{%s} %d\n", db, m.parametersDrifted)
+
+	metric("pgstratify_lock_wait_seconds", "histogram", "Time each attempt to alter an object spent waiting for locks, by wait mode.")
+	for _, mode := range []string{"nowait", "wait"} {
+		h, ok := m.lockWait[mode]
+		if !ok {
+			continue
+		}
+		labels := fmt.Sprintf("%s,mode=%s", db, labelValue(mode))
+		for idx, val := range lockWaitBuckets {
+			fmt.Fprintf(&buf, "pgstratify_lock_wait_seconds_bucket{%s,le=\"%s\"} %d\n", labels, float(val), h.counts[idx])
+		}
+		fmt.Fprintf(&buf, "pgstratify_lock_wait_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(&buf, "pgstratify_lock_wait_seconds_sum{%s} %s\n", labels, float(h.sum))
+		fmt.Fprintf(&buf, "pgstratify_lock_wait_seconds_count{%s} %d\n", labels, h.count)
+	}
+
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+// write the metrics to a file, atomically, so the textfile collector never sees half of it
+// it's world-readable, since the collector usually runs as a different user
+func (m *Metrics) WriteFile(filename string) error {
+	var buf bytes.Buffer
+	_, err := m.WriteTo(&buf)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, buf.Bytes(), 0644)
+}
+
+// serve the metrics over http
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// seconds since the epoch, or 0 for the zero time (meaning never)
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
@@ -0,0 +1,255 @@
+// Copyright (c) 2022 James Lucas
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// valid values for the --output option
+var OutputFormats = []string{"text", "json", "ndjson", "csv", "tsv"}
+
+// receives the results of a run, and writes them out in some format
+type OutputWriter interface {
+	Matches(tms []TableMatch)                                               // tables covered by the matchgroups, in display-matches mode
+	Result(rslt *UpdateTableParametersResult)                               // the outcome of updating one table
+	LockSkipped(rslt *UpdateTableParametersResult, err error, waitmode int) // a table given up on because it couldn't be locked, in the given wait mode
+	Summary(rs *RunStats)                                                   // end of run
+}
+
+/*
+	Construct the OutputWriter for the given --output format and run mode (apply, dry-run,
+	or display-matches). Columns are for the display-matches report - in text format, nil
+	means the original list by matchgroup. The csv and tsv formats are only for the report.
+*/
+func NewOutputWriter(format string, mode string, columns []string) (OutputWriter, error) {
+	switch format {
+	case "text":
+		return &TextOutput{Mode: mode, Columns: columns}, nil
+	case "csv", "tsv":
+		if mode != "display-matches" {
+			return nil, fmt.Errorf("%s output can only be used with display-matches", format)
+		}
+		return &TableOutput{w: os.Stdout, format: format, columns: columns}, nil
+	case "json":
+		return &JSONOutput{w: os.Stdout, mode: mode, tables: make([]TableRecord, 0)}, nil
+	case "ndjson":
+		return &JSONOutput{w: os.Stdout, mode: mode, stream: true}, nil
+	default:
+		return nil, fmt.Errorf("invalid output value `%s`", format)
+	}
+}
+
+// the original human-oriented output, written through the logger
+type TextOutput struct {
+	Mode    string
+	Columns []string
+}
+
+func (o *TextOutput) Matches(tms []TableMatch) {
+	if o.Columns == nil {
+		MatchDisplay(os.Stdout, tms)
+		return
+	}
+	err := WriteMatchTable(os.Stdout, tms, o.Columns, "text")
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (o *TextOutput) Result(rslt *UpdateTableParametersResult) {
+	rslt.OutputResult()
+}
+
+// tables skipped in nowait mode get their result too, but a wait that timed out only gets the warning
+func (o *TextOutput) LockSkipped(rslt *UpdateTableParametersResult, err error, waitmode int) {
+	if waitmode != WaitModeWait {
+		rslt.OutputResult()
+	}
+	rslt.LogEntry().Warn(err)
+}
+
+// display-matches output has always stood on its own, without a summary
+func (o *TextOutput) Summary(rs *RunStats) {
+	switch o.Mode {
+	case "dry-run":
+		rs.OutputStatsDryRun()
+	case "apply":
+		rs.OutputStats()
+	}
+}
+
+// a storage parameter change, as written in json output
+type ParameterRecord struct {
+	Name    string  `json:"name"`
+	Old     *string `json:"old"`
+	New     *string `json:"new"`
+	Success *bool   `json:"success,omitempty"` // omitted in display-matches mode, where nothing is attempted
+	Error   string  `json:"error,omitempty"`
+}
+
+// a table, as written in json output
+type TableRecord struct {
+	Type           string            `json:"type,omitempty"` // only set in ndjson output, where record types are mixed
+	Table          string            `json:"table"`
+	Relkind        string            `json:"relkind"`
+	Owner          string            `json:"owner"`
+	Reltuples      int               `json:"reltuples"`
+	RowcountSource string            `json:"rowcount_source"`
+	NeverAnalyzed  bool              `json:"never_analyzed"`
+	Matchgroup     int               `json:"matchgroup"`
+	Ruleset        string            `json:"ruleset"`
+	Minrows        *int              `json:"minrows"`
+	Attempts       int               `json:"attempts,omitempty"`
+	LockSkipped    bool              `json:"lock_skipped,omitempty"`
+	Error          string            `json:"error,omitempty"`
+	Parameters     []ParameterRecord `json:"parameters"`
+	Reloptions     []string          `json:"reloptions,omitempty"`      // display-matches only
+	LastAutovacuum *time.Time        `json:"last_autovacuum,omitempty"` // display-matches only
+}
+
+// end of run summary, as written in json output
+type SummaryRecord struct {
+	Type                string `json:"type,omitempty"`
+	Mode                string `json:"mode"`
+	TablesMatched       int    `json:"tables_matched"`
+	MViewsMatched       int    `json:"mviews_matched"`
+	ParametersMatched   int    `json:"parameters_matched"`
+	ParametersAttempted int    `json:"parameters_attempted"`
+	ParametersSet       int    `json:"parameters_set"`
+	ParametersErrored   int    `json:"parameters_errored"`
+	TablesSkippedLocked int    `json:"tables_skipped_locked"`
+	ParametersDrifted   int    `json:"parameters_drifted"`
+	ExitCode            int    `json:"exit_code"`       // what --detailed-exit-codes would exit with
+	Error               string `json:"error,omitempty"` // why the run was aborted
+}
+
+/*
+	Structured output. In json mode, records are collected and written as a single
+	document at the end of the run. In ndjson mode, each record is written on its
+	own line as soon as we have it, with the summary last.
+*/
+type JSONOutput struct {
+	w      io.Writer
+	mode   string
+	stream bool
+	tables []TableRecord
+	mutex  sync.Mutex
+}
+
+// build the record for a table, with its parameters in sorted order
+func newTableRecord(tm *TableMatch) TableRecord {
+	relkind := map[rune]string{'r': "table", 'm': "materialized view"}[tm.Relkind]
+	rec := TableRecord{Table: tm.QuotedFullName, Relkind: relkind, Owner: tm.Owner, Reltuples: tm.Reltuples, RowcountSource: tm.RowcountSource, NeverAnalyzed: tm.NeverAnalyzed, Matchgroup: tm.MatchgroupNum, Ruleset: tm.Matchgroup.Ruleset, Minrows: tm.Minrows, Parameters: make([]ParameterRecord, 0, len(tm.Parameters)), Reloptions: tm.Reloptions, LastAutovacuum: tm.LastAutovacuum}
+	for _, key := range tm.SortedParameters() {
+		rec.Parameters = append(rec.Parameters, ParameterRecord{Name: key, Old: tm.Parameters[key].OldSetting, New: tm.Parameters[key].NewSetting})
+	}
+	return rec
+}
+
+// in ndjson mode write the record now, otherwise save it for the document
+func (o *JSONOutput) add(rec TableRecord, rectype string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.stream {
+		rec.Type = rectype
+		o.write(rec)
+		return
+	}
+	o.tables = append(o.tables, rec)
+}
+
+// write a value as a single line
+func (o *JSONOutput) write(v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = o.w.Write(append(buf, '\n'))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (o *JSONOutput) Matches(tms []TableMatch) {
+	for idx := range tms {
+		o.add(newTableRecord(&tms[idx]), "match")
+	}
+}
+
+func (o *JSONOutput) Result(rslt *UpdateTableParametersResult) {
+	rec := newTableRecord(&rslt.Match)
+	rec.Attempts = rslt.Attempts
+	// parameters come back in the same sorted order, but match them by name anyway
+	for _, val := range rslt.SettingSuccess {
+		for idx := range rec.Parameters {
+			if rec.Parameters[idx].Name == val.Setting {
+				success := val.Success
+				rec.Parameters[idx].Success = &success
+				if val.Err != nil {
+					rec.Parameters[idx].Error = val.Err.Error()
+				}
+			}
+		}
+	}
+	o.add(rec, "result")
+}
+
+func (o *JSONOutput) LockSkipped(rslt *UpdateTableParametersResult, err error, waitmode int) {
+	rec := newTableRecord(&rslt.Match)
+	rec.Attempts = rslt.Attempts
+	rec.LockSkipped = true
+	rec.Error = err.Error()
+	o.add(rec, "result")
+}
+
+func (o *JSONOutput) Summary(rs *RunStats) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	summary := SummaryRecord{Mode: o.mode, TablesMatched: rs.TablesMatched, MViewsMatched: rs.MViewsMatched, ParametersMatched: rs.ParametersMatched, ParametersAttempted: rs.ParametersAttempted, ParametersSet: rs.ParametersSet, ParametersErrored: rs.ParametersErrored, TablesSkippedLocked: rs.TablesSkippedLocked, ParametersDrifted: rs.ParametersDrifted, ExitCode: rs.ExitCode(o.mode == "dry-run")}
+	if o.mode == "display-matches" {
+		summary.ExitCode = ExitNoChanges
+	}
+	if rs.Err != nil {
+		summary.Error = rs.Err.Error()
+	}
+	if o.stream {
+		summary.Type = "summary"
+		o.write(summary)
+		return
+	}
+	o.write(struct {
+		Tables  []TableRecord `json:"tables"`
+		Summary SummaryRecord `json:"summary"`
+	}{o.tables, summary})
+	o.tables = make([]TableRecord, 0)
+}
+
+// the display-matches report as csv or tsv, for loading into spreadsheets
+type TableOutput struct {
+	w       io.Writer
+	format  string
+	columns []string
+}
+
+func (o *TableOutput) Matches(tms []TableMatch) {
+	err := WriteMatchTable(o.w, tms, o.columns, o.format)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// nothing is applied in display-matches mode, and the report has no summary
+
+func (o *TableOutput) Result(rslt *UpdateTableParametersResult) {}
+
+func (o *TableOutput) LockSkipped(rslt *UpdateTableParametersResult, err error, waitmode int) {}
+
+func (o *TableOutput) Summary(rs *RunStats) {}
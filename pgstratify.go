@@ -3,17 +3,22 @@
 package main
 
 import (
-	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 
 	"github.com/pborman/getopt/v2"
 
 	"os"
+	"os/signal"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -23,39 +28,6 @@ import (
 
 const Version string = "0.0.2"
 
-// Define custom log formatter with very minimal output.
-// We're only really using log levels for verbosity - we
-// don't need fancy formatting.
-type PlainFormatter struct{}
-
-func (f *PlainFormatter) Format(entry *log.Entry) ([]byte, error) {
-	return []byte(entry.Message + "\n"), nil
-}
-
-// custom logging hook to set output to stdout for info, debug, and trace
-type OutHook struct{}
-
-func (oh *OutHook) Levels() []log.Level {
-	return []log.Level{log.InfoLevel, log.DebugLevel, log.TraceLevel}
-}
-
-func (oh *OutHook) Fire(e *log.Entry) error {
-	log.SetOutput(os.Stdout)
-	return nil
-}
-
-// custom logging hook to set output to stderr for panic, fatal, error, and warn
-type ErrHook struct{}
-
-func (eh *ErrHook) Levels() []log.Level {
-	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel, log.WarnLevel}
-}
-
-func (eh *ErrHook) Fire(e *log.Entry) error {
-	log.SetOutput(os.Stderr)
-	return nil
-}
-
 // individual rule definition from yaml config
 type ConfigRule struct {
 	Minrows  uint64             `yaml:"minrows"`
@@ -91,13 +63,56 @@ func (cr *ConfigRuleset) UnmarshalYAML(unmarshal func(interface{}) error) error
 	return err
 }
 
+// valid values for a matchgroup's rowcount_source
+var RowcountSources = []string{"reltuples", "live_tuples", "estimate", "exact"}
+
+// valid values for a matchgroup's drift_policy
+var DriftPolicies = []string{"revert", "warn", "adopt"}
+
 // matchgroup from yaml config
 type ConfigMatchgroup struct {
-	Schema        string `yaml:"schema"`
-	Table         string `yaml:"table"`
-	Owner         string `yaml:"owner"`
-	CaseSensitive bool   `yaml:"case_sensitive"`
-	Ruleset       string `yaml:"ruleset"`
+	Schema            string `yaml:"schema"`
+	Table             string `yaml:"table"`
+	Owner             string `yaml:"owner"`
+	CaseSensitive     bool   `yaml:"case_sensitive"`
+	Ruleset           string `yaml:"ruleset"`
+	RowcountSource    string `yaml:"rowcount_source"`
+	ExactCountMaxSize string `yaml:"exact_count_max_size"`
+	DriftPolicy       string `yaml:"drift_policy"`
+}
+
+// unmarshaling of matchgroup with defaults and validation of rowcount source and drift policy
+func (cm *ConfigMatchgroup) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// alias type without this method, so we don't recurse forever
+	type rawMatchgroup ConfigMatchgroup
+	r := rawMatchgroup{RowcountSource: "reltuples", ExactCountMaxSize: "100MB", DriftPolicy: "revert"}
+	err := unmarshal(&r)
+	if err != nil {
+		return err
+	}
+
+	valid := false
+	for _, val := range RowcountSources {
+		if r.RowcountSource == val {
+			valid = true
+		}
+	}
+	if !valid {
+		return fmt.Errorf("invalid rowcount_source `%s` (must be one of: %s)", r.RowcountSource, strings.Join(RowcountSources, ", "))
+	}
+
+	valid = false
+	for _, val := range DriftPolicies {
+		if r.DriftPolicy == val {
+			valid = true
+		}
+	}
+	if !valid {
+		return fmt.Errorf("invalid drift_policy `%s` (must be one of: %s)", r.DriftPolicy, strings.Join(DriftPolicies, ", "))
+	}
+
+	*cm = ConfigMatchgroup(r)
+	return nil
 }
 
 // overall yaml config file
@@ -106,6 +121,54 @@ type ConfigFile struct {
 	Rulesets    map[string]ConfigRuleset `yaml:"rulesets"`
 }
 
+// whether any matchgroup has a drift policy that needs the history to tell what we last applied
+func (c *ConfigFile) NeedsHistory() bool {
+	for _, val := range c.Matchgroups {
+		if val.DriftPolicy != "revert" {
+			return true
+		}
+	}
+	return false
+}
+
+// read and parse a yaml config file
+func ReadConfigFile(filename string) (*ConfigFile, error) {
+	x := ConfigFile{}
+
+	dat, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// parse it
+	err = yaml.UnmarshalStrict(dat, &x)
+	if err != nil {
+		/*
+			yaml.TypeError's string representation exposes implementation details,
+			like type names, so we perform string substitution to hide that.
+		*/
+		x := new(yaml.TypeError)
+		if errors.As(err, &x) {
+			intypere, reerr := regexp.Compile(`(?m) in type .*$`)
+			if reerr != nil {
+				log.Panic(reerr)
+			}
+			intore, reerr := regexp.Compile(`(?m) cannot unmarshal !!.+ ` + "`" + `(.*)` + "`" + ` .*$`)
+			if reerr != nil {
+				log.Panic(reerr)
+			}
+
+			if intore.MatchString(x.Error()) {
+				return nil, errors.New(intore.ReplaceAllString(x.Error(), " invalid value `$1`"))
+			}
+
+			return nil, errors.New(intypere.ReplaceAllLiteralString(x.Error(), ""))
+		}
+		return nil, err
+	}
+	return &x, nil
+}
+
 // old and new settings for a table parameter
 type TableMatchParameter struct {
 	OldSetting *string
@@ -114,15 +177,24 @@ type TableMatchParameter struct {
 
 // table that matched in the database, with parameters in need of update
 type TableMatch struct {
-	Reloid         int
-	Relkind        rune
-	QuotedFullName string
-	Owner          string
-	Reltuples      int
-	MatchgroupNum  int
-	Matchgroup     *ConfigMatchgroup
-	Minrows        *int //nil if no match, which can happen in display mode
-	Parameters     map[string]TableMatchParameter
+	Reloid          int
+	Relkind         rune
+	QuotedFullName  string
+	Owner           string
+	Reltuples       int
+	MatchgroupNum   int
+	Matchgroup      *ConfigMatchgroup
+	Minrows         *int //nil if no match, which can happen in display mode
+	Parameters      map[string]TableMatchParameter
+	Relsize         int64
+	DeadTuples      int64
+	XidAge          int
+	NeverAnalyzed   bool       // no rowcount estimate in pg_class, so Reltuples was estimated from the table's size
+	RowcountSource  string     // where Reltuples came from
+	ReconcilePolicy int        // recorded changes only - how UpdateTableParameters treats drift found once the table is locked, 0 for none
+	Schema          string     // unquoted schema name - display mode only
+	Reloptions      []string   // all current storage parameters - display mode only
+	LastAutovacuum  *time.Time // nil if never autovacuumed - display mode only
 }
 
 // returns correct sql type specifier for this tablematch
@@ -137,40 +209,145 @@ func (tm *TableMatch) RelkindString() (string, error) {
 	}
 }
 
-// given a slice of TableMatches, display them on the console for configuration debugging
-func MatchDisplay(tms []TableMatch) {
-	sortidx := make([]int, len(tms))
-	for i := 0; i < len(sortidx); i++ {
-		sortidx[i] = i
+// names of the parameters to change, in sorted order
+func (tm *TableMatch) SortedParameters() []string {
+	keys := make([]string, 0, len(tm.Parameters))
+	for key := range tm.Parameters {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
+	return keys
+}
 
-	// Not totally happy with this sorting logic, but it works
-	sort.SliceStable(sortidx, func(i, j int) bool {
-		if tms[i].MatchgroupNum == tms[j].MatchgroupNum {
-			if tms[i].Reltuples == tms[j].Reltuples {
-				return tms[i].QuotedFullName < tms[j].QuotedFullName
-			}
+// valid values for the --order-by option
+var TableMatchOrders = []string{"name", "rows", "size", "dead-tuples", "xid-age", "band-change"}
+
+// sort a slice of TableMatches in place, so the most impactful changes are processed first
+// name ordering is what the database returned, so it's left alone
+// rulesets are needed for band-change ordering - without them (for recorded changes) every table moves 0 bands
+func SortTableMatches(tms []TableMatch, orderby string, rulesets map[string]ConfigRuleset) error {
+	var key func(tm *TableMatch) int64
+	switch orderby {
+	case "name":
+		return nil
+	case "rows":
+		key = func(tm *TableMatch) int64 { return int64(tm.Reltuples) }
+	case "size":
+		key = func(tm *TableMatch) int64 { return tm.Relsize }
+	case "dead-tuples":
+		key = func(tm *TableMatch) int64 { return tm.DeadTuples }
+	case "xid-age":
+		key = func(tm *TableMatch) int64 { return int64(tm.XidAge) }
+	case "band-change":
+		sorted := make(map[string][]ConfigRule)
+		for name, ruleset := range rulesets {
+			rules := make([]ConfigRule, len(ruleset))
+			copy(rules, ruleset)
+			sort.Slice(rules, func(i, j int) bool { return rules[i].Minrows < rules[j].Minrows })
+			sorted[name] = rules
+		}
+		key = func(tm *TableMatch) int64 { return int64(tm.BandChange(sorted[tm.Matchgroup.Ruleset])) }
+	default:
+		return fmt.Errorf("invalid order-by value `%s` (must be one of: %s)", orderby, strings.Join(TableMatchOrders, ", "))
+	}
+
+	// descending by key, with ties broken by rowcount and then name order from the database
+	sort.SliceStable(tms, func(i, j int) bool {
+		ki, kj := key(&tms[i]), key(&tms[j])
+		if ki == kj {
 			return tms[i].Reltuples > tms[j].Reltuples
 		}
-		return tms[i].MatchgroupNum < tms[j].MatchgroupNum
+		return ki > kj
 	})
+	return nil
+}
+
+/*
+	How many bands the table moves, given its ruleset's rules in minrows order - from the band
+	its current settings match best to the one the rules put it in. pg_class doesn't record
+	which band a table was in, so that's inferred: each band's effective settings (unset where
+	no rule has set a parameter yet) are compared against the table's current settings, and
+	the band matching the most of them wins, the nearest to the target on a tie. Below the
+	lowest rule counts as a band, with everything unset.
+*/
+func (tm *TableMatch) BandChange(rules []ConfigRule) int {
+	if len(rules) == 0 {
+		return 0
+	}
+	// effective settings of each band, index 0 being below the lowest rule
+	bands := make([]map[string]*string, len(rules)+1)
+	bands[0] = make(map[string]*string)
+	target := 0
+	for idx := range rules {
+		bands[idx+1] = make(map[string]*string)
+		for key, val := range bands[idx] {
+			bands[idx+1][key] = val
+		}
+		for key, val := range rules[idx].Settings {
+			bands[idx+1][key] = val
+		}
+		if tm.Minrows != nil && *tm.Minrows >= 0 && uint64(*tm.Minrows) == rules[idx].Minrows {
+			target = idx + 1
+		}
+	}
+
+	// the current settings we know - parameters that aren't changing already have their target setting
+	current := make(map[string]*string)
+	for key, val := range bands[target] {
+		current[key] = val
+	}
+	for key, val := range tm.Parameters {
+		current[key] = val.OldSetting
+	}
+
+	distance := func(idx int) int {
+		if idx > target {
+			return idx - target
+		}
+		return target - idx
+	}
+	best, bestscore := target, -1
+	for idx := range bands {
+		score := 0
+		for key, val := range current {
+			if settingsEqual(bands[idx][key], val) {
+				score++
+			}
+		}
+		if score > bestscore || (score == bestscore && distance(idx) < distance(best)) {
+			best, bestscore = idx, score
+		}
+	}
+	return distance(best)
+}
 
+// given a slice of TableMatches, write them to w for configuration debugging - this is a report, not log messages
+// they're listed under a heading for each matchgroup, so should be sorted in matchgroup order
+func MatchDisplay(w io.Writer, tms []TableMatch) {
 	objtype := map[rune]string{'r': "TABLE", 'm': "MVIEW"}
 	csmap := map[bool]rune{true: 't', false: 'f'}
 
 	lastgroup := 0
-	for _, val := range sortidx {
-		if tms[val].MatchgroupNum != lastgroup {
+	for idx := range tms {
+		tm := &tms[idx]
+		if tm.MatchgroupNum != lastgroup {
 			if lastgroup != 0 {
-				log.Debug("")
+				fmt.Fprintln(w, "")
 			}
-			log.Debugf(`Matchgroup %d (Ruleset: %s) - Schema: "%s", Table: "%s", Owner: "%s", CaseSensitive: %c`, tms[val].MatchgroupNum, tms[val].Matchgroup.Ruleset, tms[val].Matchgroup.Schema, tms[val].Matchgroup.Table, tms[val].Matchgroup.Owner, csmap[tms[val].Matchgroup.CaseSensitive])
-			lastgroup = tms[val].MatchgroupNum
+			fmt.Fprintf(w, "Matchgroup %d (Ruleset: %s) - Schema: \"%s\", Table: \"%s\", Owner: \"%s\", CaseSensitive: %c\n", tm.MatchgroupNum, tm.Matchgroup.Ruleset, tm.Matchgroup.Schema, tm.Matchgroup.Table, tm.Matchgroup.Owner, csmap[tm.Matchgroup.CaseSensitive])
+			lastgroup = tm.MatchgroupNum
+		}
+		neveranalyzed := ""
+		if tm.RowcountSource != "reltuples" {
+			neveranalyzed = fmt.Sprintf(" [%s]", tm.RowcountSource)
 		}
-		if tms[val].Minrows != nil {
-			log.Debugf(`  %-6s %-40s %-16s %11d rows (>= minrows %d)`, objtype[tms[val].Relkind], tms[val].QuotedFullName, tms[val].Owner, tms[val].Reltuples, *tms[val].Minrows)
+		if tm.NeverAnalyzed {
+			neveranalyzed += " [estimated, never analyzed]"
+		}
+		if tm.Minrows != nil {
+			fmt.Fprintf(w, "  %-6s %-40s %-16s %11d rows (>= minrows %d)%s\n", objtype[tm.Relkind], tm.QuotedFullName, tm.Owner, tm.Reltuples, *tm.Minrows, neveranalyzed)
 		} else {
-			log.Debugf(`  %-6s %-40s %-16s %11d rows (no matching minrows)`, objtype[tms[val].Relkind], tms[val].QuotedFullName, tms[val].Owner, tms[val].Reltuples)
+			fmt.Fprintf(w, "  %-6s %-40s %-16s %11d rows (no matching minrows)%s\n", objtype[tm.Relkind], tm.QuotedFullName, tm.Owner, tm.Reltuples, neveranalyzed)
 		}
 	}
 }
@@ -203,6 +380,10 @@ func (co *ConnectOptions) BuildDSN() string {
 	if escaped.DBName != nil && *escaped.DBName != "" {
 		components = append(components, fmt.Sprintf("dbname='%s'", *escaped.DBName))
 	}
+	// given several hosts, look for the primary rather than taking the first that answers
+	if escaped.Host != nil && strings.Contains(*escaped.Host, ",") {
+		components = append(components, "target_session_attrs=read-write")
+	}
 	return strings.Join(components, " ")
 }
 
@@ -249,6 +430,19 @@ func (co *ConnectOptions) PromptPassword() error {
 	}
 }
 
+// exit codes reported with --detailed-exit-codes
+// without it, we exit 0 on anything that isn't fatal
+const (
+	ExitNoChanges      = 0 // nothing needed changing
+	ExitFatal          = 1 // the run was aborted (this is also what log.Fatal exits with)
+	ExitChangesApplied = 2 // parameters were changed, without errors
+	ExitChangesPending = 3 // dry-run found parameters that need changing
+	ExitLockSkipped    = 4 // one or more tables were skipped because they couldn't be locked
+	ExitPartialFailure = 5 // one or more parameters could not be set
+	ExitConcurrentRun  = 6 // another run holds the run lock, so we did nothing
+	ExitStandby        = 7 // the server is a hot standby, so we did nothing
+)
+
 // runtime statistics for output at end of run
 type RunStats struct {
 	TablesMatched       int
@@ -257,31 +451,95 @@ type RunStats struct {
 	ParametersAttempted int
 	ParametersSet       int
 	ParametersErrored   int
+	TablesSkippedLocked int
+	ParametersDrifted   int          // parameters changed outside pgstratify since we last applied them
+	CompletedTables     map[int]bool // reloids of tables where every parameter was set
+	Err                 error        // why the run was aborted, nil if it wasn't
 	accessLock          sync.Mutex
 }
 
+// record a table that was given up on because it couldn't be locked - also accessed from goroutines
+func (rs *RunStats) RecordLockSkip() {
+	rs.accessLock.Lock()
+	defer rs.accessLock.Unlock()
+	rs.TablesSkippedLocked++
+}
+
+// the detailed exit code describing the outcome of the run
+// if more than one applies, errors take priority over lock skips, which take priority over changes
+func (rs *RunStats) ExitCode(dryrun bool) int {
+	switch {
+	case rs.Err != nil:
+		return ExitFatal
+	case rs.ParametersErrored > 0:
+		return ExitPartialFailure
+	case rs.TablesSkippedLocked > 0:
+		return ExitLockSkipped
+	case rs.ParametersSet > 0 && dryrun:
+		return ExitChangesPending
+	case rs.ParametersSet > 0:
+		return ExitChangesApplied
+	default:
+		return ExitNoChanges
+	}
+}
+
 // update the paramter stats - this method will be accessed from goroutines so it needs a mutex
 func (rs *RunStats) UpdateFromResult(result *UpdateTableParametersResult) {
 	rs.accessLock.Lock()
 	defer rs.accessLock.Unlock()
+	completed := len(result.SettingSuccess) > 0
 	for _, val := range result.SettingSuccess {
 		rs.ParametersAttempted++
 		if val.Success {
 			rs.ParametersSet++
 		} else {
 			rs.ParametersErrored++
+			completed = false
 		}
 	}
+	if completed {
+		if rs.CompletedTables == nil {
+			rs.CompletedTables = make(map[int]bool)
+		}
+		rs.CompletedTables[result.Match.Reloid] = true
+	}
+}
+
+// count the objects and parameters to be changed
+func (rs *RunStats) CountMatches(tms []TableMatch) {
+	for _, val := range tms {
+		switch val.Relkind {
+		case 'r':
+			rs.TablesMatched++
+		case 'm':
+			rs.MViewsMatched++
+		}
+		rs.ParametersMatched += len(val.Parameters)
+	}
 }
 
 // output the runtime stats
 func (rs *RunStats) OutputStats() {
-	log.Infof("%d Objects Matched, %d Parameters Modified, %d Parameter Errors", rs.TablesMatched+rs.MViewsMatched, rs.ParametersSet, rs.ParametersErrored)
+	if rs.TablesSkippedLocked > 0 {
+		log.Infof("%d Objects Matched, %d Parameters Modified, %d Parameter Errors, %d Objects Skipped (Locked)", rs.TablesMatched+rs.MViewsMatched, rs.ParametersSet, rs.ParametersErrored, rs.TablesSkippedLocked)
+	} else {
+		log.Infof("%d Objects Matched, %d Parameters Modified, %d Parameter Errors", rs.TablesMatched+rs.MViewsMatched, rs.ParametersSet, rs.ParametersErrored)
+	}
+	rs.outputDrift()
 }
 
 // output the runtime stats for a dry-run (different formatting)
 func (rs *RunStats) OutputStatsDryRun() {
 	log.Infof("%d Objects Matched, %d Parameters Modified (Dry-Run)", rs.TablesMatched+rs.MViewsMatched, rs.ParametersSet)
+	rs.outputDrift()
+}
+
+// drift only gets a mention when there was some
+func (rs *RunStats) outputDrift() {
+	if rs.ParametersDrifted > 0 {
+		log.Infof("%d Parameters Changed Outside pgstratify", rs.ParametersDrifted)
+	}
 }
 
 // this is here instead of dbinterface file because it's user-facing output
@@ -298,42 +556,122 @@ func (rslt *UpdateTableParametersResult) OutputResult() {
 		log.Fatal(err)
 	}
 
+	// only mention attempts when it took more than one
+	attempts := ""
+	if rslt.Match.RowcountSource != "reltuples" {
+		attempts = fmt.Sprintf(" from %s", rslt.Match.RowcountSource)
+	}
+	if rslt.Match.NeverAnalyzed {
+		attempts += ", estimated, never analyzed"
+	}
+	if rslt.Attempts > 1 {
+		attempts += fmt.Sprintf(", %d attempts", rslt.Attempts)
+	}
+
+	tlog := rslt.LogEntry()
 	if anyfailed {
-		log.Infof("%s %s [%d rows]:", objecttype, rslt.Match.QuotedFullName, rslt.Match.Reltuples)
+		tlog.Infof("%s %s [%d rows%s]:", objecttype, rslt.Match.QuotedFullName, rslt.Match.Reltuples, attempts)
 	} else {
-		log.Debugf("%s %s [%d rows]:", objecttype, rslt.Match.QuotedFullName, rslt.Match.Reltuples)
+		tlog.Debugf("%s %s [%d rows%s]:", objecttype, rslt.Match.QuotedFullName, rslt.Match.Reltuples, attempts)
 	}
 	for _, val := range rslt.SettingSuccess {
+		param := rslt.Match.Parameters[val.Setting]
+		plog := tlog.WithFields(log.Fields{"parameter": val.Setting, "old": logSetting(param.OldSetting), "new": logSetting(param.NewSetting)})
 		if val.Success {
-			if rslt.Match.Parameters[val.Setting].NewSetting == nil {
-				log.Debugf("  Reset %s (previous setting %s)", val.Setting, *rslt.Match.Parameters[val.Setting].OldSetting)
+			if param.NewSetting == nil {
+				plog.Debugf("  Reset %s (previous setting %s)", val.Setting, *param.OldSetting)
 			} else {
-				if rslt.Match.Parameters[val.Setting].OldSetting == nil {
-					log.Debugf("  Set %s to %s (previously unset)", val.Setting, *rslt.Match.Parameters[val.Setting].NewSetting)
+				if param.OldSetting == nil {
+					plog.Debugf("  Set %s to %s (previously unset)", val.Setting, *param.NewSetting)
 				} else {
-					log.Debugf("  Set %s to %s (previous setting %s)", val.Setting, *rslt.Match.Parameters[val.Setting].NewSetting, *rslt.Match.Parameters[val.Setting].OldSetting)
+					plog.Debugf("  Set %s to %s (previous setting %s)", val.Setting, *param.NewSetting, *param.OldSetting)
 				}
 			}
 		} else {
-			log.Warnf("  Failed to set %s: %v", val.Setting, val.Err)
+			plog.Warnf("  Failed to set %s: %v", val.Setting, val.Err)
 		}
 	}
 }
 
+// a log entry carrying the table and worker as fields
+func (rslt *UpdateTableParametersResult) LogEntry() *log.Entry {
+	return log.WithFields(log.Fields{"table": rslt.Match.QuotedFullName, "worker": rslt.Worker})
+}
+
+// a parameter setting as a log field - nil (meaning unset) comes out as null, rather than a pointer
+func logSetting(setting *string) interface{} {
+	if setting == nil {
+		return nil
+	}
+	return *setting
+}
+
 // display usage message, then exit with status
 func usage(status int) {
 	fmt.Printf(`pgstratify scans the database and modifies storage parameters based on rules.
 
 Usage:
   %s [OPTION] ... [RULEFILE]
+  %s [OPTION] ... plan -o PLANFILE RULEFILE
+  %s [OPTION] ... apply PLANFILE
+  %s [OPTION] ... undo UNDOFILE
+  %s [OPTION] ... install-history
+  %s [OPTION] ... explain TABLE RULEFILE
 
 Options:
+      --alter-idle-timeout=DURATION
+                                  idle_in_transaction_session_timeout for alter transactions
+      --alter-statement-timeout=DURATION
+                                  statement_timeout for alter transactions (includes lock waits)
+      --analyze-stale             analyze matched tables with stale statistics before evaluating rules
+      --catalog-idle-timeout=DURATION
+                                  idle_in_transaction_session_timeout for catalog transactions
+      --catalog-statement-timeout=DURATION
+                                  statement_timeout for catalog queries
+      --combine-alters            set all parameters for a table in a single alter statement where possible
+      --daemon                    keep running, updating storage parameters every interval
+      --detailed-exit-codes       exit with a status describing the outcome (see README)
+      --display-columns=LIST      with display-matches, show these columns as a table (see README)
       --display-matches           take no action, and display tables covered by each matchgroup
+      --display-matchgroup=LIST   with display-matches, only show these matchgroup numbers
+      --display-max-rows=NUM      with display-matches, only show tables with at most NUM rows
+      --display-min-rows=NUM      with display-matches, only show tables with at least NUM rows
+      --display-pending           with display-matches, only show tables with changes pending
+      --display-schema=LIST       with display-matches, only show tables in these schemas
+      --display-sort=ORDER        with display-matches, sort by this (matchgroup, name, rows, size, last-autovacuum)
+      --display-unmatched         with display-matches, show tables not covered by any matchgroup instead
   -n, --dry-run                   output what would be done without making changes (implies -v)
+      --emit-sql=FILE             write the statements that would be run to FILE, instead of running them (implies -n)
+      --error-retries=NUM         retry a table this many times after a deadlock or lost connection (default 3)
+      --full                      evaluate every relation, even if the state file says it hasn't changed
+      --history-schema=SCHEMA     record every change in the history tables in SCHEMA
+      --interval=DURATION         time between runs in daemon mode (e.g. 1h, 30m)
+      --jitter=DURATION           random extra delay added to each interval (default 10%% of interval)
   -j, --jobs=NUM                  use this many concurrent connections to set storage parameters
+      --lock-passes=NUM           number of nowait passes to make over locked tables before waiting (default 1)
+      --lock-retry-delay=NUM      seconds to wait before the second nowait pass, doubling each pass (default 1)
+      --lock-retry-max-delay=NUM  maximum seconds to wait between nowait passes (default 30)
       --lock-timeout=NUM          per-table wait timeout in seconds (must be greater than 0, no effect in skip-locked mode)
+      --log-file=FILE             append log messages to FILE instead of writing them to stdout and stderr
+      --log-format=FORMAT         write log messages as plain text, json, or logfmt (with fields)
+      --metrics-file=FILE         write prometheus metrics to FILE after each run
+      --metrics-listen=ADDR       serve prometheus metrics over http at ADDR in daemon mode (e.g. :9187)
+      --never-analyzed=POLICY     how to treat tables with no rowcount estimate (skip, estimate, analyze)
+      --on-plan-drift=POLICY      with apply, skip tables that changed since planning, or refuse to apply at all (skip, refuse)
+      --order-by=ORDER            process tables in this order (name, rows, size, dead-tuples, xid-age, band-change)
+  -o, --out=FILE                  with plan, write the plan to FILE
+      --output=FORMAT             write results as text, a json document, or ndjson records (or csv, tsv with display-matches)
+      --pass-lock-timeout=NUM     per-statement lock timeout in seconds during nowait passes (default 0.001)
+      --reset-managed-only        only reset parameters pgstratify set itself (needs history-schema)
+      --run-lock-name=NAME        only exclude other runs using the same run lock name
       --skip-locked               skip tables that cannot be immediately locked
+      --stale-age=DURATION        with analyze-stale, analyze tables not analyzed for this long (e.g. 24h)
+      --stale-rows=NUM            with analyze-stale, analyze tables with more than this many rows modified since analyze
+      --state-file=FILE           remember evaluated relations here, and only re-evaluate changed ones
+      --undo-dir=DIR              write undo files into DIR (default $XDG_STATE_HOME/pgstratify/undo)
+      --unmatched-warn-size=SIZE  warn about tables not covered by any matchgroup at least this large (e.g. 1GB)
   -v, --verbose                   write a lot of output
+      --wait-for-other-run        wait for another run on the same database to finish, instead of exiting
   -V, --version                   output version information, then exit
   -?, --help                      show this help, then exit
 
@@ -345,7 +683,7 @@ Connection Options:
   -W, --password            force password prompt
   -d, --dbname              database name to connect to and update
 
-`, os.Args[0])
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 
 	os.Exit(status)
 }
@@ -399,23 +737,74 @@ func GetoptGreedy(fn func(getopt.Option) bool) error {
 }
 
 func main() {
-	// set custom formatter for logging
-	log.SetFormatter(new(PlainFormatter))
-	// set custom hooks
-	log.AddHook(new(OutHook))
-	log.AddHook(new(ErrHook))
+	// all log output goes through the router, which sends each level where it belongs
+	logrouter := NewLogRouter()
+	logrouter.Install()
 	// default to Info level
 	log.SetLevel(log.InfoLevel)
 
 	var connectoptions ConnectOptions
 
+	opt_alter_idle_timeout := new(time.Duration)
+	getopt.FlagLong(opt_alter_idle_timeout, "alter-idle-timeout", 0)
+	opt_alter_statement_timeout := new(time.Duration)
+	getopt.FlagLong(opt_alter_statement_timeout, "alter-statement-timeout", 0)
+	opt_analyze_stale := getopt.BoolLong("analyze-stale", 0)
+	opt_catalog_idle_timeout := new(time.Duration)
+	getopt.FlagLong(opt_catalog_idle_timeout, "catalog-idle-timeout", 0)
+	opt_catalog_statement_timeout := new(time.Duration)
+	getopt.FlagLong(opt_catalog_statement_timeout, "catalog-statement-timeout", 0)
+	opt_combine_alters := getopt.BoolLong("combine-alters", 0)
+	opt_daemon := getopt.BoolLong("daemon", 0)
+	opt_detailed_exit_codes := getopt.BoolLong("detailed-exit-codes", 0)
+	opt_display_columns := getopt.StringLong("display-columns", 0, "")
 	opt_display_matches := getopt.BoolLong("display-matches", 0)
+	opt_display_matchgroup := getopt.StringLong("display-matchgroup", 0, "")
+	opt_display_max_rows := getopt.Int64Long("display-max-rows", 0, -1)
+	opt_display_min_rows := getopt.Int64Long("display-min-rows", 0, 0)
+	opt_display_pending := getopt.BoolLong("display-pending", 0)
+	opt_display_schema := getopt.StringLong("display-schema", 0, "")
+	opt_display_sort := getopt.StringLong("display-sort", 0, "matchgroup")
+	opt_display_unmatched := getopt.BoolLong("display-unmatched", 0)
 	opt_dry_run := getopt.BoolLong("dry-run", 'n')
+	opt_emit_sql := getopt.StringLong("emit-sql", 0, "")
+	opt_error_retries := getopt.IntLong("error-retries", 0, 3)
+	opt_full := getopt.BoolLong("full", 0)
+	opt_history_schema := getopt.StringLong("history-schema", 0, "")
+	opt_interval := new(time.Duration)
+	getopt.FlagLong(opt_interval, "interval", 0)
+	opt_jitter := new(time.Duration)
+	getopt.FlagLong(opt_jitter, "jitter", 0)
 	opt_jobs := getopt.IntLong("jobs", 'j', 1)
 	opt_lock_timeout := new(float64)
 	getopt.FlagLong(opt_lock_timeout, "lock-timeout", 0)
+	opt_lock_passes := getopt.IntLong("lock-passes", 0, 1)
+	opt_pass_lock_timeout := new(float64)
+	getopt.FlagLong(opt_pass_lock_timeout, "pass-lock-timeout", 0)
+	opt_lock_retry_delay := new(float64)
+	getopt.FlagLong(opt_lock_retry_delay, "lock-retry-delay", 0)
+	opt_lock_retry_max_delay := new(float64)
+	getopt.FlagLong(opt_lock_retry_max_delay, "lock-retry-max-delay", 0)
+	opt_log_file := getopt.StringLong("log-file", 0, "")
+	opt_log_format := getopt.EnumLong("log-format", 0, LogFormats, "text")
+	opt_metrics_file := getopt.StringLong("metrics-file", 0, "")
+	opt_metrics_listen := getopt.StringLong("metrics-listen", 0, "")
+	opt_never_analyzed := getopt.EnumLong("never-analyzed", 0, []string{"skip", "estimate", "analyze"}, "skip")
+	opt_on_plan_drift := getopt.EnumLong("on-plan-drift", 0, []string{"skip", "refuse"}, "skip")
+	opt_order_by := getopt.StringLong("order-by", 0, "name")
+	opt_out := getopt.StringLong("out", 'o', "")
+	opt_output := getopt.EnumLong("output", 0, OutputFormats, "text")
+	opt_reset_managed_only := getopt.BoolLong("reset-managed-only", 0)
+	opt_run_lock_name := getopt.StringLong("run-lock-name", 0, "")
 	opt_skip_locked := getopt.BoolLong("skip-locked", 0)
+	opt_stale_age := new(time.Duration)
+	getopt.FlagLong(opt_stale_age, "stale-age", 0)
+	opt_stale_rows := getopt.Int64Long("stale-rows", 0, 0)
+	opt_state_file := getopt.StringLong("state-file", 0, "")
+	opt_undo_dir := getopt.StringLong("undo-dir", 0, "")
+	opt_unmatched_warn_size := getopt.StringLong("unmatched-warn-size", 0, "")
 	opt_verbose := getopt.BoolLong("verbose", 'v')
+	opt_wait_for_other_run := getopt.BoolLong("wait-for-other-run", 0)
 	opt_version := getopt.BoolLong("version", 'V')
 	opt_help := getopt.BoolLong("help", '?')
 	connectoptions.Host = getopt.StringLong("host", 'h', "")
@@ -460,58 +849,307 @@ func main() {
 		log.Fatal(errors.New("lock-timeout, when specified, must be greater than 0"))
 	}
 
-	// dry-run implies verbose
-	if *opt_dry_run {
-		*opt_verbose = true
+	if *opt_error_retries < 0 {
+		log.Fatal(errors.New("number of error retries must not be negative"))
 	}
 
-	if *opt_verbose {
-		log.SetLevel(log.DebugLevel)
+	if *opt_lock_passes < 1 {
+		log.Fatal(errors.New("number of lock passes must be at least 1"))
 	}
 
-	x := ConfigFile{}
+	if getopt.GetCount("pass-lock-timeout") == 0 {
+		*opt_pass_lock_timeout = 0.001
+	} else if *opt_pass_lock_timeout <= 0 {
+		log.Fatal(errors.New("pass-lock-timeout, when specified, must be greater than 0"))
+	}
 
-	// read the config file
-	if len(getopt.Args()) < 1 {
-		log.Fatal(fmt.Errorf("rulefile name must be specified"))
-	} else if len(getopt.Args()) > 1 {
-		log.Fatal(fmt.Errorf("more than one rulefile name may not be specified"))
+	if getopt.GetCount("lock-retry-delay") == 0 {
+		*opt_lock_retry_delay = 1
+	} else if *opt_lock_retry_delay < 0 {
+		log.Fatal(errors.New("lock-retry-delay must not be negative"))
 	}
-	dat, err := os.ReadFile(getopt.Args()[0])
-	if err != nil {
+
+	if getopt.GetCount("lock-retry-max-delay") == 0 {
+		*opt_lock_retry_max_delay = 30
+	} else if *opt_lock_retry_max_delay < *opt_lock_retry_delay {
+		log.Fatal(errors.New("lock-retry-max-delay must not be less than lock-retry-delay"))
+	}
+
+	if *opt_daemon {
+		if *opt_display_matches {
+			log.Fatal(errors.New("display-matches cannot be used in daemon mode"))
+		}
+		if *opt_interval <= 0 {
+			log.Fatal(errors.New("interval must be specified, and greater than 0, in daemon mode"))
+		}
+		// default to jittering by up to a tenth of the interval
+		if getopt.GetCount("jitter") == 0 {
+			*opt_jitter = *opt_interval / 10
+		} else if *opt_jitter < 0 {
+			log.Fatal(errors.New("jitter must not be negative"))
+		}
+	} else if getopt.GetCount("interval") > 0 || getopt.GetCount("jitter") > 0 {
+		log.Fatal(errors.New("interval and jitter can only be used in daemon mode"))
+	} else if *opt_metrics_listen != "" {
+		log.Fatal(errors.New("metrics-listen can only be used in daemon mode"))
+	}
+
+	if *opt_analyze_stale {
+		if getopt.GetCount("stale-rows") == 0 && getopt.GetCount("stale-age") == 0 {
+			log.Fatal(errors.New("analyze-stale requires stale-rows, stale-age, or both"))
+		}
+		if *opt_stale_rows < 0 || *opt_stale_age < 0 {
+			log.Fatal(errors.New("stale-rows and stale-age must not be negative"))
+		}
+	} else if getopt.GetCount("stale-rows") > 0 || getopt.GetCount("stale-age") > 0 {
+		log.Fatal(errors.New("stale-rows and stale-age can only be used with analyze-stale"))
+	}
+
+	if *opt_catalog_statement_timeout < 0 || *opt_catalog_idle_timeout < 0 || *opt_alter_statement_timeout < 0 || *opt_alter_idle_timeout < 0 {
+		log.Fatal(errors.New("statement and idle timeouts must not be negative"))
+	}
+
+	if *opt_full && *opt_state_file == "" {
+		log.Fatal(errors.New("full can only be used with state-file"))
+	}
+
+	neveranalyzed := map[string]int{"skip": NeverAnalyzedSkip, "estimate": NeverAnalyzedEstimate, "analyze": NeverAnalyzedAnalyze}[*opt_never_analyzed]
+
+	// validate order-by up front, so we don't connect just to fail
+	if err := SortTableMatches(nil, *opt_order_by, nil); err != nil {
 		log.Fatal(err)
 	}
 
-	// parse it
-	err = yaml.UnmarshalStrict(dat, &x)
-	if err != nil {
-		/*
-			yaml.TypeError's string representation exposes implementation details,
-			like type names, so we perform string substitution to hide that.
-		*/
-		x := new(yaml.TypeError)
-		if errors.As(err, &x) {
-			intypere, reerr := regexp.Compile(`(?m) in type .*$`)
-			if reerr != nil {
-				log.Panic(reerr)
+	/*
+		Filters, columns, and sorting for the display-matches report. A report with columns
+		is a table (or csv or tsv) - the original list by matchgroup only makes sense in
+		matchgroup order, so other orders get the default columns.
+	*/
+	var displaycolumns []string
+	displayfilter := MatchFilter{PendingOnly: *opt_display_pending}
+	if *opt_display_matches {
+		if err := SortMatchDisplay(nil, *opt_display_sort); err != nil {
+			log.Fatal(err)
+		}
+		if *opt_display_columns != "" {
+			displaycolumns, err = ParseDisplayColumns(*opt_display_columns)
+			if err != nil {
+				log.Fatal(err)
 			}
-			intore, reerr := regexp.Compile(`(?m) cannot unmarshal !!.+ ` + "`" + `(.*)` + "`" + ` .*$`)
-			if reerr != nil {
-				log.Panic(reerr)
+		} else if *opt_display_unmatched {
+			displaycolumns = UnmatchedDisplayColumns
+		} else if *opt_output == "csv" || *opt_output == "tsv" || *opt_display_sort != "matchgroup" {
+			displaycolumns = DefaultDisplayColumns
+		}
+		if *opt_display_unmatched && (*opt_display_matchgroup != "" || *opt_display_pending) {
+			log.Fatal(errors.New("display-matchgroup and display-pending cannot be used with display-unmatched"))
+		}
+		if *opt_display_matchgroup != "" {
+			displayfilter.Matchgroups = make(map[int]bool)
+			for _, val := range strings.Split(*opt_display_matchgroup, ",") {
+				num, err := strconv.Atoi(strings.TrimSpace(val))
+				if err != nil || num < 1 {
+					log.Fatal(fmt.Errorf("invalid display-matchgroup value `%s`", val))
+				}
+				displayfilter.Matchgroups[num] = true
 			}
-
-			if intore.MatchString(x.Error()) {
-				errstr := intore.ReplaceAllString(x.Error(), " invalid value `$1`")
-				log.Fatal(errstr)
+		}
+		if *opt_display_schema != "" {
+			displayfilter.Schemas = make(map[string]bool)
+			for _, val := range strings.Split(*opt_display_schema, ",") {
+				displayfilter.Schemas[strings.TrimSpace(val)] = true
 			}
+		}
+		if *opt_display_min_rows < 0 {
+			log.Fatal(errors.New("display-min-rows must not be negative"))
+		}
+		if getopt.GetCount("display-max-rows") > 0 && *opt_display_max_rows < *opt_display_min_rows {
+			log.Fatal(errors.New("display-max-rows must not be less than display-min-rows"))
+		}
+		// only filter on rows when asked to
+		if getopt.GetCount("display-min-rows") > 0 {
+			displayfilter.MinRows = opt_display_min_rows
+		}
+		if getopt.GetCount("display-max-rows") > 0 {
+			displayfilter.MaxRows = opt_display_max_rows
+		}
+	} else {
+		for _, val := range []string{"display-columns", "display-matchgroup", "display-max-rows", "display-min-rows", "display-pending", "display-schema", "display-sort", "display-unmatched"} {
+			if getopt.GetCount(val) > 0 {
+				log.Fatal(fmt.Errorf("%s can only be used with display-matches", val))
+			}
+		}
+		if *opt_output == "csv" || *opt_output == "tsv" {
+			log.Fatal(fmt.Errorf("%s output can only be used with display-matches", *opt_output))
+		}
+	}
 
-			errstr := intypere.ReplaceAllLiteralString(x.Error(), "")
-			log.Fatal(errstr)
-		} else {
+	// structured output owns stdout, so everything else goes to stderr
+	if *opt_output != "text" {
+		logrouter.SetStdout(os.Stderr)
+	}
+	err = logrouter.SetFormat(*opt_log_format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *opt_log_file != "" {
+		err = logrouter.SetFile(*opt_log_file)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	/*
+		The first argument may be a command. Without one, it's the rulefile for a normal run.
+		  plan RULEFILE    evaluate the rules, and save the changes to the --out file without making them
+		  apply PLANFILE   make the changes saved by plan
+		  undo UNDOFILE    put back the changes recorded in an undo file
+		  install-history  create or upgrade the history schema
+		  explain TABLE RULEFILE  show how the rules apply to one table, without changing anything
+	*/
+	args := getopt.Args()
+	command := ""
+	explaintable := ""
+	if len(args) > 0 {
+		switch args[0] {
+		case "plan", "apply", "undo", "install-history", "explain":
+			command = args[0]
+			args = args[1:]
+		}
+	}
+	switch command {
+	case "install-history":
+		if len(args) != 0 {
+			log.Fatal(fmt.Errorf("install-history does not take a rulefile"))
+		}
+		if *opt_dry_run || *opt_display_matches {
+			log.Fatal(errors.New("install-history cannot be used with dry-run or display-matches"))
+		}
+		if *opt_history_schema == "" {
+			*opt_history_schema = "pgstratify"
+		}
+	case "plan":
+		if *opt_out == "" {
+			log.Fatal(errors.New("plan requires an output file (-o)"))
+		}
+		if *opt_daemon || *opt_display_matches {
+			log.Fatal(errors.New("plan cannot be used with daemon or display-matches"))
+		}
+		// planning means not applying
+		*opt_dry_run = true
+	case "explain":
+		if len(args) != 2 {
+			log.Fatal(errors.New("explain requires a table name and a rulefile"))
+		}
+		if *opt_daemon || *opt_display_matches || *opt_emit_sql != "" || *opt_state_file != "" || *opt_output != "text" {
+			log.Fatal(errors.New("explain cannot be used with daemon, display-matches, emit-sql, state-file, or output"))
+		}
+		explaintable = args[0]
+		args = args[1:]
+	case "apply", "undo":
+		if len(args) != 1 {
+			log.Fatal(fmt.Errorf("%s requires exactly one file name", command))
+		}
+		if *opt_daemon || *opt_display_matches || *opt_emit_sql != "" || *opt_state_file != "" {
+			log.Fatal(fmt.Errorf("%s cannot be used with daemon, display-matches, emit-sql, or state-file", command))
+		}
+	}
+	if *opt_out != "" && command != "plan" {
+		log.Fatal(errors.New("out can only be used with plan"))
+	}
+	if *opt_reset_managed_only && *opt_history_schema == "" {
+		log.Fatal(errors.New("reset-managed-only requires history-schema"))
+	}
+	if getopt.GetCount("on-plan-drift") > 0 && command != "apply" {
+		log.Fatal(errors.New("on-plan-drift can only be used with apply"))
+	}
+
+	// emitting sql means not applying it ourselves
+	if *opt_emit_sql != "" {
+		if *opt_display_matches || *opt_daemon {
+			log.Fatal(errors.New("emit-sql cannot be used with display-matches or in daemon mode"))
+		}
+		*opt_dry_run = true
+	}
+
+	// dry-run implies verbose
+	if *opt_dry_run {
+		*opt_verbose = true
+	}
+
+	if *opt_verbose {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	// read the config file, or the file the command works from
+	var rulefile string
+	var config *ConfigFile
+	var plan *PlanFile
+	var recorded []TableMatch
+	var recordeddesc string
+	switch command {
+	case "install-history":
+		// nothing to read
+	case "undo":
+		undotables, err := ReadUndoFile(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		for idx := range undotables {
+			recorded = append(recorded, undotables[idx].TableMatch())
+		}
+		recordeddesc = fmt.Sprintf("undoing changes from %s", args[0])
+	case "apply":
+		plan, err = ReadPlanFile(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		recorded = plan.TableMatches()
+		recordeddesc = fmt.Sprintf("applying plan %s (created %s)", args[0], plan.Created.Format(time.RFC3339))
+	default:
+		if len(args) < 1 {
+			log.Fatal(fmt.Errorf("rulefile name must be specified"))
+		} else if len(args) > 1 {
+			log.Fatal(fmt.Errorf("more than one rulefile name may not be specified"))
+		}
+		rulefile = args[0]
+		config, err = ReadConfigFile(rulefile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// every run that changes anything writes an undo file, into the default directory unless told otherwise
+	undodir := *opt_undo_dir
+	if undodir != "" {
+		if info, err := os.Stat(undodir); err != nil {
+			log.Fatal(err)
+		} else if !info.IsDir() {
+			log.Fatal(fmt.Errorf("undo-dir %s is not a directory", undodir))
+		}
+	} else if !*opt_dry_run && !*opt_display_matches && command != "explain" && command != "install-history" {
+		undodir, err = DefaultUndoDir()
+		if err != nil {
 			log.Fatal(err)
 		}
 	}
 
+	/*
+		Tag every session in application_name with an id for this run, and what the session is
+		for, so they can be told apart in pg_stat_activity.
+	*/
+	runid := fmt.Sprintf("%08x", jitterRand.Uint32())
+	logrouter.SetField("run_id", runid)
+	session := func(role string) SessionOptions {
+		return SessionOptions{
+			ApplicationName:         fmt.Sprintf("pgstratify %s %s", runid, role),
+			CatalogStatementTimeout: *opt_catalog_statement_timeout,
+			CatalogIdleTimeout:      *opt_catalog_idle_timeout,
+			AlterStatementTimeout:   *opt_alter_statement_timeout,
+			AlterIdleTimeout:        *opt_alter_idle_timeout,
+		}
+	}
+
 	// connect to the database
 	// if -W was passed, prompt for password up front
 	if *opt_password {
@@ -524,251 +1162,657 @@ func main() {
 	// if initial attempt fails, -w was not passed, and
 	// we haven't previously prompted, prompt for password
 	// and try again
-	conn, err := NewDBInterface(&connectoptions)
-	if err != nil {
-		var pwerr *PasswordAuthenticationError
-		if errors.As(err, &pwerr) && !(*opt_password || *opt_no_password) {
-			err := connectoptions.PromptPassword()
-			if err != nil {
-				log.Fatal(err)
-			}
-			conn, err = NewDBInterface(&connectoptions)
-			if err != nil {
-				log.Fatal(err)
-			}
-		} else {
+	conn, err := NewDBInterface(&connectoptions, session("main"))
+	var pwerr *PasswordAuthenticationError
+	if errors.As(err, &pwerr) && !(*opt_password || *opt_no_password) {
+		err = connectoptions.PromptPassword()
+		if err != nil {
 			log.Fatal(err)
 		}
+		conn, err = NewDBInterface(&connectoptions, session("main"))
+	}
+	// a standby has nothing for us to do - this is expected after a failover, so it isn't an error
+	var sberr *StandbyError
+	if errors.As(err, &sberr) {
+		log.Infof("Skipping, %v", err)
+		if *opt_detailed_exit_codes {
+			os.Exit(ExitStandby)
+		}
+		os.Exit(0)
 	}
-
-	log.Infof(`pgstratify: updating storage parameters for database "%s"`, conn.CurrentDB())
-
-	// retrieve all the matching tables
-	tablematches, err := conn.GetTableMatches(x.Matchgroups, x.Rulesets, *opt_display_matches)
 	if err != nil {
 		log.Fatal(err)
 	}
+	dbname := conn.CurrentDB()
+	logrouter.SetField("database", dbname)
 
-	// populate run stats
-	var runstats RunStats
-	for _, val := range tablematches {
-		switch val.Relkind {
-		case 'r':
-			runstats.TablesMatched++
-		case 'm':
-			runstats.MViewsMatched++
+	if command == "install-history" {
+		oldversion, newversion, err := conn.InstallHistory(*opt_history_schema)
+		if err != nil {
+			log.Fatal(err)
 		}
-		for range val.Parameters {
-			runstats.ParametersMatched++
+		if oldversion == newversion {
+			log.Infof(`History schema %s in database "%s" is already at version %d`, *opt_history_schema, dbname, newversion)
+		} else if oldversion == 0 {
+			log.Infof(`Installed history schema %s in database "%s" (version %d)`, *opt_history_schema, dbname, newversion)
+		} else {
+			log.Infof(`Upgraded history schema %s in database "%s" from version %d to %d`, *opt_history_schema, dbname, oldversion, newversion)
 		}
-	}
-
-	// in display-matches mode, we output the matches here and then exit
-	if *opt_display_matches {
-		log.SetLevel(log.DebugLevel)
-		MatchDisplay(tablematches)
+		conn.Close()
 		os.Exit(0)
 	}
 
-	// allocate db connections up to *opt_jobs (or len(tablematches), whichever is less)
-	connections := []*DBInterface{conn}
-	for i := 1; i < func(a int, b int) int {
-		if a < b {
-			return a
-		}
-		return b
-	}(len(tablematches), *opt_jobs); i++ {
-		var newconn *DBInterface
-		var err error
-		if *opt_dry_run {
-			/*
-				An ugly hack, but in the case of a dry-run, there's
-				no need to open additional connections to the database,
-				but we still want the structs so we can use their
-				methods without having totally separate execution flow.
-				Zero structs should be enough for this limited case.
-			*/
-			newconn, err = new(DBInterface), nil
-		} else {
-			newconn, err = NewDBInterface(&connectoptions)
-		}
+	// the same checks are made when the daemon reloads the rulefile
+	if config != nil {
+		err = conn.ValidateConfig(config, *opt_history_schema != "")
 		if err != nil {
 			log.Fatal(err)
 		}
-		connections = append(connections, newconn)
 	}
 
-	/*
-		We make a first opportunistic pass through the tables and try to set
-		parameters in nowait mode. Hopefully this knocks out the majority of
-		the tables near the start of the run.
-		We suppress output of anything that failed to lock during this pass
-		because they will be retried.
-	*/
+	if *opt_unmatched_warn_size != "" {
+		err = conn.ValidateSize("unmatched-warn-size", *opt_unmatched_warn_size)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	// goroutine iterating over tablematches and returning them on a channel
-	matchiter := make(chan TableMatch)
-	go func(matchiter chan<- TableMatch) {
-		for _, v := range tablematches {
-			matchiter <- v
+	// explaining only reads, so there's no run lock, history, or anything else to set up
+	if command == "explain" {
+		explanation, err := conn.ExplainTable(explaintable, config, neveranalyzed)
+		if err != nil {
+			log.Fatal(err)
 		}
-		close(matchiter)
-	}(matchiter)
+		explanation.Output(config.Rulesets)
+		conn.Close()
+		os.Exit(0)
+	}
 
-	// goroutine receiving failed tablematches from workers
-	lockpendingrcv := make(chan TableMatch)
-	lockpendingret := make(chan []TableMatch)
-	go func(matchin <-chan TableMatch, matchesout chan<- []TableMatch) {
-		lockpending := make([]TableMatch, 0)
-		for m := range matchin {
-			lockpending = append(lockpending, m)
+	// a plan only makes sense against the database it was made for
+	if plan != nil && plan.Database != dbname {
+		log.Fatal(fmt.Errorf(`plan was created for database "%s", not "%s"`, plan.Database, dbname))
+	}
+
+	// check history is ready up front, rather than failing every table - a dry run reads it too, to find drift
+	if *opt_history_schema != "" && !*opt_display_matches {
+		err = conn.CheckHistory(*opt_history_schema)
+		if err != nil {
+			log.Fatal(err)
 		}
-		matchesout <- lockpending
-	}(lockpendingrcv, lockpendingret)
+	}
 
 	/*
-		Launch a goroutine for each connection, each reading matches from matchiter.
-		Tables that fail to lock are fed to lockpendingrcv (other errors are fatal).
-		When matchiter is closed, close donechan to signal goroutine is complete.
+		Unless we're only looking, make sure no other pgstratify run is working on this
+		database at the same time. The lock lives on its own connection, so we can release
+		it cleanly if we're interrupted. In daemon mode, the lock is held for as long as
+		the daemon runs.
 	*/
-	// mutex for synchronizing multi-line output - it's not worth juggling more channels for this
-	// log is already threadsafe - this is just to keep goroutines from interleaving output lines
-	var outmutex sync.Mutex
-	donechans := make([]chan bool, 0, len(connections))
-	for _, val := range connections {
-		donechan := make(chan bool)
-		donechans = append(donechans, donechan)
-		go func(conn *DBInterface, lockpendingrcv chan<- TableMatch, donechan chan<- bool) {
-			for m := range matchiter {
-				rslt, err := conn.UpdateTableParameters(m, *opt_dry_run, WaitModeNowait, 0)
-				if err != nil {
-					var alerr *AcquireLockError
-					if errors.As(err, &alerr) {
-						if *opt_skip_locked {
-							outmutex.Lock()
-							// in skip-locked modes, don't emit to channel
-							// also we need to output even on lock failure
-							rslt.OutputResult()
-							// we also want to emit the warning in skip-locked mode
-							log.Warn(err)
-							outmutex.Unlock()
-						} else {
-							lockpendingrcv <- m
-						}
-					} else {
-						log.Fatal(err)
+	var runlock *RunLock
+	if !(*opt_dry_run || *opt_display_matches) {
+		lockconn, err := NewDBInterface(&connectoptions, session("runlock"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		runlock = NewRunLock(lockconn, *opt_run_lock_name)
+	}
+
+	// on interrupt, release the run lock and exit - in daemon mode, SIGHUP requests a rulefile reload
+	reloadchan := make(chan bool, 1)
+	if runlock != nil || *opt_daemon {
+		sigchan := make(chan os.Signal, 1)
+		signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+		if *opt_daemon {
+			signal.Notify(sigchan, syscall.SIGHUP)
+		}
+		go func() {
+			for sig := range sigchan {
+				if sig == syscall.SIGHUP {
+					// a rotated log file gets replaced
+					err := logrouter.Reopen()
+					if err != nil {
+						log.Errorf("Unable to reopen log file: %v", err)
 					}
-				} else {
-					// only output on sucess since tables will be retried
-					outmutex.Lock()
-					rslt.OutputResult()
-					outmutex.Unlock()
+					// a reload is already pending if the channel is full
+					select {
+					case reloadchan <- true:
+					default:
+					}
+					continue
 				}
-				// record result stats - mutex synchronized internally
-				runstats.UpdateFromResult(&rslt)
+				log.Warnf("Received %v, exiting", sig)
+				if runlock != nil {
+					runlock.Release()
+				}
+				os.Exit(128 + int(sig.(syscall.Signal)))
+			}
+		}()
+	}
+
+	if runlock != nil {
+		if *opt_wait_for_other_run {
+			log.Debug("Waiting for any other pgstratify run on this database to finish")
+		}
+		acquired, err := runlock.Acquire(*opt_wait_for_other_run)
+		if errors.Is(err, ErrRunLockReleased) {
+			// we were interrupted while waiting - the signal handler exits once the lock is released
+			select {}
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !acquired {
+			log.Info("Another pgstratify run is already in progress on this database, exiting")
+			runlock.Release()
+			if *opt_detailed_exit_codes {
+				os.Exit(ExitConcurrentRun)
 			}
-			close(donechan)
-		}(val, lockpendingrcv, donechan)
+			os.Exit(0)
+		}
 	}
 
-	// wait until all donechans are closed
-	for _, donechan := range donechans {
-		<-donechan
+	altermode := AlterModeSeparate
+	if *opt_combine_alters {
+		altermode = AlterModeCombined
 	}
 
-	// close lockpendingrcv
-	close(lockpendingrcv)
+	retry := LockRetryOptions{
+		NowaitPasses:    *opt_lock_passes,
+		PassLockTimeout: *opt_pass_lock_timeout,
+		RetryDelay:      *opt_lock_retry_delay,
+		MaxRetryDelay:   *opt_lock_retry_max_delay,
+		WaitTimeout:     *opt_lock_timeout,
+		SkipLocked:      *opt_skip_locked,
+		ErrorRetries:    *opt_error_retries,
+	}
 
-	// retrieve lockpending, and close lockpendingret
-	lockpending := <-lockpendingret
-	close(lockpendingret)
+	// pool of connections for updating tables - the first is also used for finding matches
+	// in daemon mode, these stay open between runs
+	connections := []*DBInterface{conn}
 
-	// if nothing is pending, we are done
-	if len(lockpending) == 0 {
-		// close all connections
-		for _, val := range connections {
-			if *opt_dry_run && val.conn == nil {
+	// allocate db connections up to *opt_jobs (or n, whichever is less)
+	growpool := func(n int) error {
+		jobs := func(a int, b int) int {
+			if a < b {
+				return a
+			}
+			return b
+		}(n, *opt_jobs)
+		for len(connections) < jobs {
+			var newconn *DBInterface
+			var err error
+			if *opt_dry_run {
+				/*
+					An ugly hack, but in the case of a dry-run, there's
+					no need to open additional connections to the database,
+					but we still want the structs so we can use their
+					methods without having totally separate execution flow.
+					Zero structs should be enough for this limited case.
+				*/
+				newconn, err = new(DBInterface), nil
 			} else {
-				val.Close()
+				newconn, err = NewDBInterface(&connectoptions, session(fmt.Sprintf("worker %d", len(connections))))
+			}
+			if err != nil {
+				return err
 			}
+			connections = append(connections, newconn)
 		}
-		if *opt_dry_run {
-			runstats.OutputStatsDryRun()
-		} else {
-			runstats.OutputStats()
+		return nil
+	}
+
+	runmode := "apply"
+	if *opt_display_matches {
+		runmode = "display-matches"
+	} else if *opt_dry_run {
+		runmode = "dry-run"
+	}
+
+	// update the given tables, writing an undo file afterwards
+	// metrics describe real runs, so there are none in dry-run or display-matches mode
+	var metrics *Metrics
+	if (*opt_metrics_file != "" || *opt_metrics_listen != "") && !(*opt_dry_run || *opt_display_matches) {
+		metrics = NewMetrics(dbname)
+	}
+	writemetrics := func() {
+		if metrics == nil || *opt_metrics_file == "" {
+			return
+		}
+		err := metrics.WriteFile(*opt_metrics_file)
+		if err != nil {
+			log.Warnf("Unable to write metrics file %s: %v", *opt_metrics_file, err)
 		}
-		os.Exit(0)
 	}
 
-	// otherwise, if we have more connections than pending tables, close some
-	overconns := len(connections) - len(lockpending)
-	if overconns > 0 {
-		for _, val := range connections[len(connections)-overconns:] {
-			val.Close()
+	// every run gets its own id in the history - a daemon numbers its runs
+	runcount := 0
+	historytarget := func() *HistoryTarget {
+		if *opt_history_schema == "" || *opt_dry_run {
+			return nil
 		}
-		connections = append([]*DBInterface(nil), connections[0:len(connections)-overconns]...)
-	}
-
-	// now another iterator goroutine to cycle through the remaining tables
-	matchiter = make(chan TableMatch)
-	go func(matchiter chan<- TableMatch) {
-		for _, v := range lockpending {
-			matchiter <- v
-		}
-		close(matchiter)
-	}(matchiter)
-
-	// goroutines for each connection, pulling from matchiter and modifying in wait mode
-	donechans = make([]chan bool, 0, len(connections))
-	for _, val := range connections {
-		donechan := make(chan bool)
-		donechans = append(donechans, donechan)
-		go func(conn *DBInterface, donechan chan<- bool) {
-			for m := range matchiter {
-				// if we wait more than a second, output a wait message
-				waitctx, waitcancel := context.WithCancel(context.Background())
-				go func() {
-					timer := time.NewTimer(time.Second)
-					select {
-					case <-waitctx.Done():
-						break
-					case <-timer.C:
-						log.Warnf("Waiting for lock on table %s", m.QuotedFullName)
-					}
-					// drain the channel, per the docs
-					if !timer.Stop() {
-						<-timer.C
+		history := &HistoryTarget{Schema: *opt_history_schema, RunID: runid}
+		if *opt_daemon {
+			history.RunID = fmt.Sprintf("%s-%d", runid, runcount)
+		}
+		return history
+	}
+
+	applymatches := func(tablematches []TableMatch, rulesets map[string]ConfigRuleset, runstats *RunStats, output OutputWriter, started time.Time) error {
+		// put the most impactful changes first, so they land before any lock skips or interruptions
+		err := SortTableMatches(tablematches, *opt_order_by, rulesets)
+		if err != nil {
+			return err
+		}
+
+		if *opt_emit_sql != "" {
+			// a script run by hand shouldn't queue behind a long transaction either, so without --lock-timeout it gets the pass timeout
+			locktimeout := *opt_lock_timeout
+			if locktimeout <= 0 {
+				locktimeout = *opt_pass_lock_timeout
+			}
+			err = WriteSQLScriptFile(*opt_emit_sql, tablematches, dbname, altermode, locktimeout)
+			if err != nil {
+				return err
+			}
+			log.Infof("Wrote SQL for %d objects to %s", len(tablematches), *opt_emit_sql)
+		}
+
+		if *opt_out != "" {
+			confighash, err := ConfigHash(config)
+			if err != nil {
+				return err
+			}
+			err = NewPlanFile(tablematches, dbname, rulefile, confighash).Write(*opt_out)
+			if err != nil {
+				return err
+			}
+			log.Infof("Wrote plan for %d objects to %s", len(tablematches), *opt_out)
+		}
+
+		err = growpool(len(tablematches))
+		if err != nil {
+			return err
+		}
+
+		var undolog *UndoLog
+		if undodir != "" && !*opt_dry_run {
+			undolog = NewUndoLog(undodir, dbname, runid)
+		}
+
+		history := historytarget()
+
+		runner := Runner{
+			Connections: connections,
+			DryRun:      *opt_dry_run,
+			AlterMode:   altermode,
+			Retry:       retry,
+			Stats:       runstats,
+			Output:      output,
+			Undo:        undolog,
+			History:     history,
+			Metrics:     metrics,
+		}
+		err = runner.Apply(tablematches)
+
+		// the undo file was written as tables were changed, so it's complete even if the run stopped partway
+		if undolog != nil {
+			undofile, werr := undolog.Close()
+			if werr != nil {
+				if err == nil {
+					return werr
+				}
+				log.Errorf("Unable to write undo file: %v", werr)
+			} else if undofile != "" {
+				log.Infof("Wrote undo file %s", undofile)
+			}
+		}
+		// some tables may have been changed already, so report them along with the failure
+		if err != nil {
+			runstats.Err = err
+			output.Summary(runstats)
+			return err
+		}
+
+		if metrics != nil {
+			metrics.RecordRun(tablematches, runstats, started)
+			writemetrics()
+		}
+
+		if history != nil {
+			mode := "apply"
+			if command == "undo" {
+				mode = "undo"
+			}
+			err = conn.RecordRun(history, started, mode, runstats, runstats.ExitCode(false))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	/*
+		Make changes recorded earlier, in an undo file or a plan. Only parameters still set
+		the way they were when the changes were recorded are changed - anything changed since
+		is left alone (or fails the run, depending on policy), since we'd be overwriting
+		someone else's work.
+	*/
+	runrecorded := func(description string, recorded []TableMatch, policy int) (*RunStats, error) {
+		started := time.Now()
+		runcount++
+		log.Infof(`pgstratify: %s for database "%s"`, description, dbname)
+
+		reloids := make([]int, 0, len(recorded))
+		for _, val := range recorded {
+			reloids = append(reloids, val.Reloid)
+		}
+		current, err := conn.GetRelationParameters(reloids)
+		if err != nil {
+			return nil, err
+		}
+		tablematches, err := ReconcileTableMatches(recorded, current, policy)
+		if err != nil {
+			return nil, err
+		}
+		// undo files don't record rowcounts
+		for idx := range tablematches {
+			if tablematches[idx].Reltuples == 0 {
+				tablematches[idx].Reltuples = current[tablematches[idx].Reloid].Reltuples
+			}
+		}
+
+		runstats := new(RunStats)
+		runstats.CountMatches(tablematches)
+		output, err := NewOutputWriter(*opt_output, runmode, nil)
+		if err != nil {
+			return nil, err
+		}
+		err = applymatches(tablematches, nil, runstats, output, started)
+		if err != nil {
+			return nil, err
+		}
+		output.Summary(runstats)
+		return runstats, nil
+	}
+
+	// find all the matching tables and update them
+	runonce := func(config *ConfigFile) (*RunStats, error) {
+		started := time.Now()
+		runcount++
+		log.Infof(`pgstratify: updating storage parameters for database "%s"`, dbname)
+
+		/*
+			In an incremental run, relations that haven't changed since the state file was
+			written are skipped. The state is only usable if it was built from the same
+			database and rules.
+		*/
+		var statefile *StateFile
+		var evalstate *EvaluationState
+		var confighash string
+		if *opt_state_file != "" && !*opt_display_matches {
+			confighash, err = ConfigHash(config)
+			if err != nil {
+				return nil, err
+			}
+			statefile, err = ReadStateFile(*opt_state_file)
+			if err != nil {
+				return nil, err
+			}
+			evalstate = new(EvaluationState)
+			switch {
+			case *opt_full:
+				log.Debug("Full evaluation requested, ignoring saved state")
+			case statefile.Database != dbname || statefile.ConfigHash != confighash:
+				log.Debug("Rules or database differ from saved state, performing full evaluation")
+			default:
+				evalstate.Known = statefile.Relations
+			}
+		}
+
+		// analyze never-analyzed and stale tables up front, so rules are evaluated against current rowcounts
+		if (neveranalyzed == NeverAnalyzedAnalyze || *opt_analyze_stale) && !*opt_display_matches {
+			rels, err := conn.GetMatchedRelations(config.Matchgroups)
+			if err != nil {
+				return nil, err
+			}
+			toanalyze := make([]MatchedRelation, 0)
+			for _, val := range rels {
+				if val.NeverAnalyzed {
+					if neveranalyzed == NeverAnalyzedAnalyze {
+						toanalyze = append(toanalyze, val)
 					}
-				}()
-				rslt, err := conn.UpdateTableParameters(m, false, WaitModeWait, *opt_lock_timeout)
-				// cancel the wait - if the message fired already this does nothing
-				waitcancel()
+				} else if *opt_analyze_stale && val.IsStale(*opt_stale_rows, *opt_stale_age) {
+					toanalyze = append(toanalyze, val)
+				}
+			}
+			if len(toanalyze) > 0 && *opt_dry_run {
+				log.Infof("%d relations would be analyzed before evaluation (Dry-Run)", len(toanalyze))
+			} else if len(toanalyze) > 0 {
+				log.Debugf("Analyzing %d relations before evaluation", len(toanalyze))
+				err = growpool(len(toanalyze))
 				if err != nil {
-					var alerr *AcquireLockError
-					if errors.As(err, &alerr) {
-						log.Warn(err)
-					} else {
-						log.Fatal(err)
-					}
-				} else {
-					outmutex.Lock()
-					rslt.OutputResult()
-					outmutex.Unlock()
+					return nil, err
+				}
+				analyzer := Runner{Connections: connections, Retry: retry}
+				err = analyzer.Analyze(toanalyze, *opt_lock_timeout)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		// retrieve all the matching tables - or for the unmatched report, all the others
+		var tablematches []TableMatch
+		if *opt_display_unmatched {
+			tablematches, err = conn.GetUnmatchedTables(config.Matchgroups, "0")
+		} else {
+			tablematches, err = conn.GetTableMatches(config.Matchgroups, config.Rulesets, *opt_display_matches, evalstate, neveranalyzed)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// large tables missing from the configuration probably shouldn't be
+		if *opt_unmatched_warn_size != "" && !*opt_display_matches {
+			unmatched, err := conn.GetUnmatchedTables(config.Matchgroups, *opt_unmatched_warn_size)
+			if err != nil {
+				return nil, err
+			}
+			for _, val := range unmatched {
+				objecttype, err := val.RelkindString()
+				if err != nil {
+					return nil, err
+				}
+				log.Warnf("%s %s is not covered by any matchgroup (%d rows, %s)", objecttype, val.QuotedFullName, val.Reltuples, prettySize(val.Relsize))
+			}
+		}
+		if evalstate != nil && len(evalstate.Unchanged) > 0 {
+			log.Debugf("Skipped %d unchanged relations", len(evalstate.Unchanged))
+		}
+
+		// leave alone, or report, parameters changed by hand since we last applied them, or that we never set
+		drifted := 0
+		if *opt_history_schema != "" && !*opt_display_matches {
+			tablematches, drifted, err = conn.CheckDrift(*opt_history_schema, historytarget(), tablematches, *opt_reset_managed_only)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// the display-matches report only shows what was asked for
+		if *opt_display_matches {
+			tablematches = displayfilter.Filter(tablematches)
+		}
+
+		// populate run stats
+		runstats := new(RunStats)
+		runstats.CountMatches(tablematches)
+		runstats.ParametersDrifted = drifted
+
+		output, err := NewOutputWriter(*opt_output, runmode, displaycolumns)
+		if err != nil {
+			return nil, err
+		}
+
+		// in display-matches mode, we output the matches and we're done
+		if *opt_display_matches {
+			err = SortMatchDisplay(tablematches, *opt_display_sort)
+			if err != nil {
+				return nil, err
+			}
+			output.Matches(tablematches)
+			output.Summary(runstats)
+			return runstats, nil
+		}
+
+		err = applymatches(tablematches, config.Rulesets, runstats, output, started)
+		if err != nil {
+			return nil, err
+		}
+
+		/*
+			Save state for the next run. Relations that were skipped carry over as-is.
+			Evaluated relations are recorded unless they still have changes outstanding
+			(errors or lock skips), so the next run takes another look at them.
+		*/
+		if evalstate != nil && !*opt_dry_run {
+			pending := make(map[int]bool, len(tablematches))
+			for _, val := range tablematches {
+				if !runstats.CompletedTables[val.Reloid] {
+					pending[val.Reloid] = true
+				}
+			}
+			newstate := StateFile{Database: dbname, ConfigHash: confighash, Relations: make(map[int]RelationState)}
+			for _, val := range evalstate.Unchanged {
+				newstate.Relations[val] = statefile.Relations[val]
+			}
+			for key, val := range evalstate.Evaluated {
+				if !pending[key] {
+					newstate.Relations[key] = val
 				}
-				// record result stats - mutex synchronized internally
-				runstats.UpdateFromResult(&rslt)
 			}
-			close(donechan)
-			// close the connection when we're done as well
-			conn.Close()
-		}(val, donechan)
+			err = newstate.Write(*opt_state_file)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		output.Summary(runstats)
+		return runstats, nil
+	}
+
+	if !*opt_daemon {
+		var runstats *RunStats
+		started := time.Now()
+		switch command {
+		case "apply":
+			policy := map[string]int{"skip": ReconcileSkipTable, "refuse": ReconcileFail}[*opt_on_plan_drift]
+			runstats, err = runrecorded(recordeddesc, recorded, policy)
+		case "undo":
+			runstats, err = runrecorded(recordeddesc, recorded, ReconcileSkipParameter)
+		default:
+			runstats, err = runonce(config)
+		}
+		if err != nil {
+			if metrics != nil {
+				metrics.RecordFailure(started)
+				writemetrics()
+			}
+			log.Fatal(err)
+		}
+
+		// close all connections, and let the next run in
+		for _, val := range connections {
+			val.Close()
+		}
+		if runlock != nil {
+			runlock.Release()
+		}
+
+		if *opt_detailed_exit_codes && !*opt_display_matches {
+			os.Exit(runstats.ExitCode(*opt_dry_run))
+		}
+		os.Exit(0)
 	}
 
-	// wait until all donechans are closed
-	for _, donechan := range donechans {
-		<-donechan
+	// daemon mode - run every interval until we're signalled to stop
+	log.Infof("pgstratify: running every %s (jitter up to %s)", *opt_interval, *opt_jitter)
+	if metrics != nil && *opt_metrics_listen != "" {
+		// listen up front, so a bad address is reported right away
+		listener, err := net.Listen("tcp", *opt_metrics_listen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		go func() {
+			log.Fatal(http.Serve(listener, mux))
+		}()
+		log.Infof("Serving metrics at http://%s/metrics", listener.Addr())
 	}
+	for {
+		// make sure we still hold the run lock, in case its connection dropped
+		locked := true
+		if runlock != nil {
+			locked, err = runlock.Ensure()
+			if err != nil {
+				log.Errorf("Unable to re-acquire run lock: %v", err)
+				locked = false
+			} else if !locked {
+				log.Warn("Another pgstratify run took the run lock while we were disconnected, skipping this run")
+			}
+		}
 
-	runstats.OutputStats()
-	os.Exit(0)
+		if locked {
+			started := time.Now()
+			_, err = runonce(config)
+			if err != nil {
+				log.Errorf("Run failed: %v", err)
+				if metrics != nil {
+					metrics.RecordFailure(started)
+					writemetrics()
+				}
+				/*
+					Workers that lost their connection reconnect on their next table, but the
+					main connection is used to find matches, so make sure it's usable before
+					the next run - whether it was the main connection or a worker that failed.
+				*/
+				if conn.ClassifyError(err) == ErrorClassConnection || conn.Ping() != nil {
+					log.Warn("Lost database connection, reconnecting")
+					err = conn.Reconnect()
+					var sberr *StandbyError
+					if errors.As(err, &sberr) {
+						log.Infof("Skipping runs until the server is promoted, %v", err)
+					} else if err != nil {
+						log.Errorf("Unable to reconnect, will try again next run: %v", err)
+					}
+				}
+			}
+		}
+
+		// wait for the next run, reloading the rulefile if asked
+		wait := *opt_interval
+		if *opt_jitter > 0 {
+			wait += time.Duration(jitterRand.Int63n(int64(*opt_jitter)))
+		}
+		log.Debugf("Next run in %s", wait.Round(time.Second))
+		timer := time.NewTimer(wait)
+	waiting:
+		for {
+			select {
+			case <-timer.C:
+				break waiting
+			case <-reloadchan:
+				newconfig, err := ReadConfigFile(rulefile)
+				if err == nil {
+					err = conn.ValidateConfig(newconfig, *opt_history_schema != "")
+				}
+				if err != nil {
+					log.Errorf("Keeping previous rules, unable to reload rulefile %s: %v", rulefile, err)
+				} else {
+					config = newconfig
+					log.Infof("Reloaded rulefile %s", rulefile)
+				}
+			}
+		}
+	}
 }
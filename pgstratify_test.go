@@ -0,0 +1,56 @@
+// Copyright (c) 2022 James Lucas
+
+package main
+
+import "testing"
+
+func TestBandChange(t *testing.T) {
+	intptr := func(i int) *int {
+		return &i
+	}
+	// three bands, each lowering the scale factor, the top one also raising the cost limit
+	rules := []ConfigRule{
+		{Minrows: 0, Settings: map[string]*string{"autovacuum_vacuum_scale_factor": strptr("0.2")}},
+		{Minrows: 1000000, Settings: map[string]*string{"autovacuum_vacuum_scale_factor": strptr("0.05")}},
+		{Minrows: 100000000, Settings: map[string]*string{"autovacuum_vacuum_scale_factor": strptr("0.01"), "autovacuum_vacuum_cost_limit": strptr("2000")}},
+	}
+
+	tests := []struct {
+		name    string
+		minrows *int
+		changes map[string]TableMatchParameter
+		want    int
+	}{
+		{"no change", intptr(1000000), map[string]TableMatchParameter{}, 0},
+		{"never configured to bottom", intptr(0), map[string]TableMatchParameter{
+			"autovacuum_vacuum_scale_factor": {OldSetting: nil, NewSetting: strptr("0.2")},
+		}, 1},
+		{"never configured to top", intptr(100000000), map[string]TableMatchParameter{
+			"autovacuum_vacuum_scale_factor": {OldSetting: nil, NewSetting: strptr("0.01")},
+			"autovacuum_vacuum_cost_limit":   {OldSetting: nil, NewSetting: strptr("2000")},
+		}, 3},
+		{"up one band", intptr(1000000), map[string]TableMatchParameter{
+			"autovacuum_vacuum_scale_factor": {OldSetting: strptr("0.2"), NewSetting: strptr("0.05")},
+		}, 1},
+		{"up two bands", intptr(100000000), map[string]TableMatchParameter{
+			"autovacuum_vacuum_scale_factor": {OldSetting: strptr("0.2"), NewSetting: strptr("0.01")},
+			"autovacuum_vacuum_cost_limit":   {OldSetting: nil, NewSetting: strptr("2000")},
+		}, 2},
+		{"down from the top", intptr(0), map[string]TableMatchParameter{
+			"autovacuum_vacuum_scale_factor": {OldSetting: strptr("0.01"), NewSetting: strptr("0.2")},
+		}, 2},
+		{"set by hand", intptr(1000000), map[string]TableMatchParameter{
+			"autovacuum_vacuum_scale_factor": {OldSetting: strptr("0.3"), NewSetting: strptr("0.05")},
+		}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tm := TableMatch{Minrows: tt.minrows, Parameters: tt.changes}
+			got := tm.BandChange(rules)
+			if got != tt.want {
+				t.Errorf("got %d bands, expected %d", got, tt.want)
+			}
+		})
+	}
+}
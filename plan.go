@@ -0,0 +1,178 @@
+// Copyright (c) 2022 James Lucas
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// version of the plan file format, bumped on incompatible changes
+const PlanFileVersion = 1
+
+// a parameter change recorded in a plan, nil meaning unset
+type PlanParameter struct {
+	Old *string `json:"old"`
+	New *string `json:"new"`
+}
+
+// a table's changes recorded in a plan, with what led to them
+type PlanTable struct {
+	Reloid         int                      `json:"reloid"`
+	Relkind        string                   `json:"relkind"`
+	QuotedFullName string                   `json:"table"`
+	Reltuples      int                      `json:"reltuples"`
+	RowcountSource string                   `json:"rowcount_source"`
+	Matchgroup     int                      `json:"matchgroup"`
+	Ruleset        string                   `json:"ruleset"`
+	Minrows        *int                     `json:"minrows"`
+	Parameters     map[string]PlanParameter `json:"parameters"`
+}
+
+// a saved plan, to be applied later by the apply command
+type PlanFile struct {
+	Version    int         `json:"version"`
+	Database   string      `json:"database"`
+	Created    time.Time   `json:"created"`
+	Rulefile   string      `json:"rulefile"`
+	ConfigHash string      `json:"config_hash"`
+	Tables     []PlanTable `json:"tables"`
+}
+
+// build a plan from the changes found by evaluating the rules
+func NewPlanFile(tms []TableMatch, dbname string, rulefile string, confighash string) *PlanFile {
+	plan := PlanFile{Version: PlanFileVersion, Database: dbname, Created: time.Now(), Rulefile: rulefile, ConfigHash: confighash, Tables: make([]PlanTable, 0, len(tms))}
+	for _, tm := range tms {
+		pt := PlanTable{Reloid: tm.Reloid, Relkind: string(tm.Relkind), QuotedFullName: tm.QuotedFullName, Reltuples: tm.Reltuples, RowcountSource: tm.RowcountSource, Matchgroup: tm.MatchgroupNum, Ruleset: tm.Matchgroup.Ruleset, Minrows: tm.Minrows, Parameters: make(map[string]PlanParameter)}
+		for key, val := range tm.Parameters {
+			pt.Parameters[key] = PlanParameter{Old: val.OldSetting, New: val.NewSetting}
+		}
+		plan.Tables = append(plan.Tables, pt)
+	}
+	return &plan
+}
+
+// write the plan to a file, atomically
+func (plan *PlanFile) Write(filename string) error {
+	buf, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, append(buf, '\n'), 0600)
+}
+
+// read a plan written by the plan command
+func ReadPlanFile(filename string) (*PlanFile, error) {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var plan PlanFile
+	err = json.Unmarshal(buf, &plan)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a valid plan file: %w", filename, err)
+	}
+	if plan.Version != PlanFileVersion {
+		return nil, fmt.Errorf("%s is plan file version %d, but this version of pgstratify reads version %d", filename, plan.Version, PlanFileVersion)
+	}
+	return &plan, nil
+}
+
+// the planned changes, as TableMatches expecting each parameter to still have its old setting
+func (plan *PlanFile) TableMatches() []TableMatch {
+	tms := make([]TableMatch, 0, len(plan.Tables))
+	for idx := range plan.Tables {
+		pt := &plan.Tables[idx]
+		tm := TableMatch{Reloid: pt.Reloid, QuotedFullName: pt.QuotedFullName, Reltuples: pt.Reltuples, RowcountSource: pt.RowcountSource, MatchgroupNum: pt.Matchgroup, Matchgroup: &ConfigMatchgroup{Ruleset: pt.Ruleset}, Minrows: pt.Minrows, Parameters: make(map[string]TableMatchParameter)}
+		if len(pt.Relkind) > 0 {
+			tm.Relkind = rune(pt.Relkind[0])
+		}
+		for key, val := range pt.Parameters {
+			tm.Parameters[key] = TableMatchParameter{OldSetting: val.Old, NewSetting: val.New}
+		}
+		tms = append(tms, tm)
+	}
+	return tms
+}
+
+// how to treat a recorded change whose parameter no longer has its expected old setting
+const (
+	ReconcileSkipParameter = 1 // leave that parameter alone, but make the table's other changes
+	ReconcileSkipTable     = 2 // leave the whole table alone
+	ReconcileFail          = 3 // fail, so nothing is changed
+)
+
+// a recorded change that no longer applies, under ReconcileFail
+type ReconcileError struct {
+	Msg string
+}
+
+func (e ReconcileError) Error() string {
+	return e.Msg
+}
+
+/*
+	Check recorded changes (from a plan or undo file) against the database's current parameters,
+	returning only the changes that still apply. A change applies if its parameter still has the
+	expected old setting. Parameters that already have the new setting are dropped quietly.
+	Relations that are gone, or whose oid now belongs to a different relation, are skipped.
+	Returns an error for the first drift found, under ReconcileFail. The changes returned carry
+	the policy, so UpdateTableParameters can check them again once it has the table locked.
+*/
+func ReconcileTableMatches(recorded []TableMatch, current map[int]RelationParameters, policy int) ([]TableMatch, error) {
+	tms := make([]TableMatch, 0, len(recorded))
+	for _, rec := range recorded {
+		rel, ok := current[rec.Reloid]
+		if !ok || rel.QuotedFullName != rec.QuotedFullName {
+			if policy == ReconcileFail {
+				return nil, &ReconcileError{fmt.Sprintf("%s no longer exists, or has been recreated", rec.QuotedFullName)}
+			}
+			log.Warnf("Skipping %s, it no longer exists, or has been recreated", rec.QuotedFullName)
+			continue
+		}
+
+		tm := rec
+		tm.ReconcilePolicy = policy
+		tm.Parameters = make(map[string]TableMatchParameter)
+		drifted := false
+		for _, key := range rec.SortedParameters() {
+			param := rec.Parameters[key]
+			switch {
+			case settingsEqual(rel.Parameters[key], param.OldSetting):
+				tm.Parameters[key] = param
+			case settingsEqual(rel.Parameters[key], param.NewSetting):
+				log.Debugf("Parameter %s on %s is already set", key, rec.QuotedFullName)
+			default:
+				msg := fmt.Sprintf("parameter %s on %s has changed since it was recorded (expected %s, found %s)", key, rec.QuotedFullName, settingString(param.OldSetting), settingString(rel.Parameters[key]))
+				switch policy {
+				case ReconcileFail:
+					return nil, &ReconcileError{msg}
+				case ReconcileSkipParameter:
+					log.Warnf("Skipping %s", msg)
+				default:
+					log.Warnf("Skipping %s, %s", rec.QuotedFullName, msg)
+				}
+				drifted = true
+			}
+		}
+		if drifted && policy == ReconcileSkipTable {
+			continue
+		}
+		if len(tm.Parameters) > 0 {
+			tms = append(tms, tm)
+		}
+	}
+	return tms, nil
+}
+
+// a parameter setting for messages, nil meaning unset
+func settingString(setting *string) string {
+	if setting == nil {
+		return "unset"
+	}
+	return *setting
+}
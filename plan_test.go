@@ -0,0 +1,118 @@
+// Copyright (c) 2022 James Lucas
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func strptr(s string) *string {
+	return &s
+}
+
+func TestReconcileTableMatches(t *testing.T) {
+	// two tables, each changing fillfactor from 100 to 70 and autovacuum_enabled from unset to off
+	recorded := func() []TableMatch {
+		tms := make([]TableMatch, 0, 2)
+		for _, val := range []struct {
+			reloid int
+			name   string
+		}{{1001, "public.a"}, {1002, "public.b"}} {
+			tms = append(tms, TableMatch{Reloid: val.reloid, Relkind: 'r', QuotedFullName: val.name, Parameters: map[string]TableMatchParameter{
+				"fillfactor":         {OldSetting: strptr("100"), NewSetting: strptr("70")},
+				"autovacuum_enabled": {OldSetting: nil, NewSetting: strptr("off")},
+			}})
+		}
+		return tms
+	}
+	unchanged := func() map[int]RelationParameters {
+		return map[int]RelationParameters{
+			1001: {QuotedFullName: "public.a", Relkind: 'r', Parameters: map[string]*string{"fillfactor": strptr("100")}},
+			1002: {QuotedFullName: "public.b", Relkind: 'r', Parameters: map[string]*string{"fillfactor": strptr("100")}},
+		}
+	}
+	dropped := func() map[int]RelationParameters {
+		current := unchanged()
+		delete(current, 1001)
+		return current
+	}
+	recreated := func() map[int]RelationParameters {
+		// a's oid now belongs to another table
+		current := unchanged()
+		current[1001] = RelationParameters{QuotedFullName: "public.c", Relkind: 'r', Parameters: map[string]*string{"fillfactor": strptr("100")}}
+		return current
+	}
+	applied := func() map[int]RelationParameters {
+		// a's fillfactor already has its new setting
+		current := unchanged()
+		current[1001].Parameters["fillfactor"] = strptr("70")
+		return current
+	}
+	drifted := func() map[int]RelationParameters {
+		// a's fillfactor was changed to something else
+		current := unchanged()
+		current[1001].Parameters["fillfactor"] = strptr("90")
+		return current
+	}
+
+	// expected result: table name -> parameters still to change, nil for an error
+	tests := []struct {
+		name    string
+		current map[int]RelationParameters
+		policy  int
+		want    map[string][]string
+	}{
+		{"unchanged/skip-parameter", unchanged(), ReconcileSkipParameter, map[string][]string{"public.a": {"autovacuum_enabled", "fillfactor"}, "public.b": {"autovacuum_enabled", "fillfactor"}}},
+		{"unchanged/skip-table", unchanged(), ReconcileSkipTable, map[string][]string{"public.a": {"autovacuum_enabled", "fillfactor"}, "public.b": {"autovacuum_enabled", "fillfactor"}}},
+		{"unchanged/fail", unchanged(), ReconcileFail, map[string][]string{"public.a": {"autovacuum_enabled", "fillfactor"}, "public.b": {"autovacuum_enabled", "fillfactor"}}},
+		{"dropped/skip-parameter", dropped(), ReconcileSkipParameter, map[string][]string{"public.b": {"autovacuum_enabled", "fillfactor"}}},
+		{"dropped/skip-table", dropped(), ReconcileSkipTable, map[string][]string{"public.b": {"autovacuum_enabled", "fillfactor"}}},
+		{"dropped/fail", dropped(), ReconcileFail, nil},
+		{"recreated/skip-parameter", recreated(), ReconcileSkipParameter, map[string][]string{"public.b": {"autovacuum_enabled", "fillfactor"}}},
+		{"recreated/skip-table", recreated(), ReconcileSkipTable, map[string][]string{"public.b": {"autovacuum_enabled", "fillfactor"}}},
+		{"recreated/fail", recreated(), ReconcileFail, nil},
+		{"applied/skip-parameter", applied(), ReconcileSkipParameter, map[string][]string{"public.a": {"autovacuum_enabled"}, "public.b": {"autovacuum_enabled", "fillfactor"}}},
+		{"applied/skip-table", applied(), ReconcileSkipTable, map[string][]string{"public.a": {"autovacuum_enabled"}, "public.b": {"autovacuum_enabled", "fillfactor"}}},
+		{"applied/fail", applied(), ReconcileFail, map[string][]string{"public.a": {"autovacuum_enabled"}, "public.b": {"autovacuum_enabled", "fillfactor"}}},
+		{"drifted/skip-parameter", drifted(), ReconcileSkipParameter, map[string][]string{"public.a": {"autovacuum_enabled"}, "public.b": {"autovacuum_enabled", "fillfactor"}}},
+		{"drifted/skip-table", drifted(), ReconcileSkipTable, map[string][]string{"public.b": {"autovacuum_enabled", "fillfactor"}}},
+		{"drifted/fail", drifted(), ReconcileFail, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tms, err := ReconcileTableMatches(recorded(), tt.current, tt.policy)
+			if tt.want == nil {
+				var rcerr *ReconcileError
+				if !errors.As(err, &rcerr) {
+					t.Fatalf("expected a ReconcileError, got %v", err)
+				}
+				if tms != nil {
+					t.Errorf("expected no changes with an error, got %d", len(tms))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := make(map[string][]string)
+			for _, tm := range tms {
+				if tm.ReconcilePolicy != tt.policy {
+					t.Errorf("%s: policy %d, expected %d", tm.QuotedFullName, tm.ReconcilePolicy, tt.policy)
+				}
+				params := make([]string, 0, len(tm.Parameters))
+				for key := range tm.Parameters {
+					params = append(params, key)
+				}
+				sort.Strings(params)
+				got[tm.QuotedFullName] = params
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -4,8 +4,38 @@ package queries
 
 const TablesTempTab string = `create temporary table tables as
 with matchjsonin as (select $1::jsonb as matchjsonin),
-tables_sub1 as (select row_number() over () as tablematchnum, schemare, tablere, ownerre, case_sensitive, ruleset from (select jsonb_array_elements(matchjsonin)->>'schemare' as schemare, jsonb_array_elements(matchjsonin)->>'tablere' as tablere, jsonb_array_elements(matchjsonin)->>'ownerre' as ownerre, (jsonb_array_elements(matchjsonin)->>'case_sensitive')::boolean as case_sensitive, jsonb_array_elements(matchjsonin)->>'ruleset' as ruleset from matchjsonin) tables_sub1a)
-select tablematchnum, reloid, relnamespace, relname, owner, reltuples, relkind, ruleset from (select ts1.tablematchnum, c.oid as reloid, c.relnamespace::regnamespace::text as relnamespace, c.relname, c.relowner::regrole::text as owner, min(ts1.tablematchnum) over (partition by c.relnamespace, c.relname) as mintablematchnum, c.reltuples, c.relkind, ts1.ruleset from pg_class c join tables_sub1 ts1 on (not ts1.case_sensitive and c.relnamespace::regnamespace::text ~* ts1.schemare and c.relname ~* ts1.tablere and c.relowner::regrole::text ~* ts1.ownerre) or (ts1.case_sensitive and c.relnamespace::regnamespace::text ~ ts1.schemare and c.relname ~ ts1.tablere and c.relowner::regrole::text ~ ts1.ownerre) where c.relpersistence='p' and c.relkind in ('r','m')) tables_a where tablematchnum = mintablematchnum`
+tables_sub1 as (select row_number() over () as tablematchnum, schemare, tablere, ownerre, case_sensitive, ruleset, rowcountsource, exactcountmaxsize from (select jsonb_array_elements(matchjsonin)->>'schemare' as schemare, jsonb_array_elements(matchjsonin)->>'tablere' as tablere, jsonb_array_elements(matchjsonin)->>'ownerre' as ownerre, (jsonb_array_elements(matchjsonin)->>'case_sensitive')::boolean as case_sensitive, jsonb_array_elements(matchjsonin)->>'ruleset' as ruleset, jsonb_array_elements(matchjsonin)->>'rowcount_source' as rowcountsource, jsonb_array_elements(matchjsonin)->>'exact_count_max_size' as exactcountmaxsize from matchjsonin) tables_sub1a)
+select tablematchnum, reloid, relnamespace, relname, owner, reltuples, relkind, ruleset, relfilenode, neveranalyzed, rawreltuples, rowcountsource, exactcountmaxsize from (select ts1.tablematchnum, c.oid as reloid, c.relnamespace::regnamespace::text as relnamespace, c.relname, c.relowner::regrole::text as owner, min(ts1.tablematchnum) over (partition by c.relnamespace, c.relname) as mintablematchnum, c.reltuples::float8 as reltuples, c.relkind, ts1.ruleset, c.relfilenode, c.reltuples < 0 as neveranalyzed, c.reltuples as rawreltuples, ts1.rowcountsource, ts1.exactcountmaxsize from pg_class c join tables_sub1 ts1 on (not ts1.case_sensitive and c.relnamespace::regnamespace::text ~* ts1.schemare and c.relname ~* ts1.tablere and c.relowner::regrole::text ~* ts1.ownerre) or (ts1.case_sensitive and c.relnamespace::regnamespace::text ~ ts1.schemare and c.relname ~ ts1.tablere and c.relowner::regrole::text ~ ts1.ownerre) where c.relpersistence='p' and c.relkind in ('r','m')) tables_a where tablematchnum = mintablematchnum`
+
+// run after the rowcount source and never-analyzed updates, so a rowcount from any source that moved is noticed
+const UnchangedTablesDelete string = `delete from pg_temp.tables t using (select reloid, reltuples, rowcount, rowcountsource, relfilenode, owner, matchgroup from jsonb_to_recordset($1::jsonb) as known(reloid bigint, reltuples float8, rowcount float8, rowcountsource text, relfilenode bigint, owner text, matchgroup bigint)) k
+where t.reloid::bigint = k.reloid and t.rawreltuples::float8 = k.reltuples and t.reltuples::float8 = k.rowcount and t.rowcountsource = k.rowcountsource and t.relfilenode::bigint = k.relfilenode and t.owner = k.owner and t.tablematchnum = k.matchgroup
+returning t.reloid::bigint`
+
+const EvaluatedTablesQuery string = `select t.reloid::bigint, t.rawreltuples::float8, t.reltuples::float8, t.rowcountsource, t.relfilenode::bigint, t.owner, t.tablematchnum, (select max(rs.minrows) from pg_temp.rulesets rs where rs.ruleset = t.ruleset and t.reltuples >= rs.minrows) as minrows from pg_temp.tables t`
+
+const RowcountSourceUpdate string = `with est as (select t.reloid, case when c.relpages > 0 and c.reltuples >= 0 then floor(c.reltuples / c.relpages * (pg_relation_size(t.reloid) / current_setting('block_size')::integer)) else c.reltuples end as reltuples, t.rowcountsource = 'exact' and pg_table_size(t.reloid) > pg_size_bytes(t.exactcountmaxsize) as toolarge from pg_temp.tables t join pg_class c on c.oid = t.reloid where t.rowcountsource <> 'reltuples')
+update pg_temp.tables t set reltuples = case
+when t.rowcountsource = 'live_tuples' then pg_stat_get_live_tuples(t.reloid)
+when t.rowcountsource = 'exact' and not est.toolarge then (xpath('/row/count/text()', query_to_xml(format('select count(*) from %s', t.reloid::regclass), false, true, '')))[1]::text::bigint
+else est.reltuples end,
+rowcountsource = case when est.toolarge then 'estimate' else t.rowcountsource end,
+neveranalyzed = t.neveranalyzed and (t.rowcountsource = 'estimate' or est.toolarge)
+from est where t.reloid = est.reloid`
+
+/*
+	Estimate rowcounts for never-analyzed tables the way the planner does without statistics (see
+	table_block_relation_estimate_size): current pages times tuples per page, where tuples per page is
+	the usable page space (block size less the 24 byte page header) integer-divided by the tuple width -
+	24 bytes of tuple header and a 4 byte line pointer, plus the column widths. Fixed-width columns count
+	their length, and variable-width columns 32 bytes, the planner's default when it has no statistics.
+*/
+const NeverAnalyzedEstimateUpdate string = `update pg_temp.tables t set reltuples = est.reltuples from (select tt.reloid, floor(pg_relation_size(tt.reloid) / current_setting('block_size')::integer * ((current_setting('block_size')::integer - 24) / (24 + 4 + coalesce((select sum(case when a.attlen > 0 then a.attlen else 32 end) from pg_attribute a where a.attrelid = tt.reloid and a.attnum > 0 and not a.attisdropped), 0)))) as reltuples from pg_temp.tables tt where tt.neveranalyzed) est where t.reloid = est.reloid`
+
+const MatchedRelationsQuery string = `select reloid::bigint, format('%I.%I',relnamespace,relname) as quotedfullname, reltuples::float8, neveranalyzed, coalesce(pg_stat_get_mod_since_analyze(reloid), 0) as modsinceanalyze, greatest(pg_stat_get_last_analyze_time(reloid), pg_stat_get_last_autoanalyze_time(reloid)) as lastanalyze from pg_temp.tables order by relnamespace, relname`
+
+// relations no matchgroup covers, at least $1 in size (in pg_size_bytes format) - the system schemas are never worth reporting
+const UnmatchedTablesQuery string = `select c.oid::integer, c.relkind, format('%I.%I',c.relnamespace::regnamespace::text,c.relname) as quotedfullname, n.nspname, c.relowner::regrole::text as owner, c.reltuples::bigint, pg_table_size(c.oid) as relsize, coalesce(c.reloptions, '{}'), pg_stat_get_last_autovacuum_time(c.oid) as lastautovacuum from pg_class c join pg_namespace n on n.oid = c.relnamespace where c.relpersistence = 'p' and c.relkind in ('r','m') and n.nspname not in ('pg_catalog', 'information_schema') and c.oid not in (select reloid from pg_temp.tables) and pg_table_size(c.oid) >= pg_size_bytes($1) order by n.nspname, c.relname`
 
 const TablesTempTabPK string = `alter table pg_temp.tables add constraint pk_tables primary key (tablematchnum, reloid)`
 
@@ -35,8 +65,9 @@ else 'f'::bool end),
 effective_settings_sub1 as (select rm.tablematchnum, rm.rulenum, rm.reloid, rm.relnamespace, rm.relname, rm.owner, rm.reltuples, rm.minrows, rm.relkind, rss.parameter, rss.setting from rulematch rm join pg_temp.rulesets_settings rss on rm.ruleset = rss.ruleset and rm.rulenum=rss.rulenum),
 effective_settings_sub2 as (select reloid, relnamespace, relname, owner, reltuples, minrows, relkind, tablematchnum, parameter, setting from effective_settings_sub1 where (tablematchnum, rulenum, reloid, relnamespace, relname, owner, parameter) in (select tablematchnum, max(rulenum) as rulenum, reloid, relnamespace, relname, owner, parameter from effective_settings_sub1 group by tablematchnum, reloid, relnamespace, relname, owner, parameter)),
 effective_settings as (select ess.reloid, ess.relnamespace, ess.relname, ess.owner, ess.reltuples, ess.minrows, ess.relkind, ess.tablematchnum, ess.parameter, tparams.setting as oldsetting, ess.setting as newsetting from effective_settings_sub2 ess left outer join tableparameters tparams on ess.reloid=tparams.reloid and ess.parameter=tparams.parameter where (ess.setting is null and (ess.reloid, ess.parameter) in (select reloid, parameter from tableparameters)) or (ess.setting is not null and (ess.reloid, ess.parameter, ess.setting) not in (select reloid, parameter, setting from tableparameters)))
-select reloid::integer, relkind, format('%I.%I',relnamespace,relname) as quotedfullname, owner, reltuples, minrows, jsonout, tablematchnum from (select reloid, relnamespace, relname, owner, reltuples, minrows, relkind, tablematchnum, json_object_agg(parameter, json_build_object('oldsetting',oldsetting,'newsetting',newsetting)) as jsonout from effective_settings group by reloid, relnamespace, relname, owner, reltuples, minrows, relkind, tablematchnum order by relnamespace, relname, owner) sub`
+select reloid::integer, relkind, format('%I.%I',relnamespace,relname) as quotedfullname, owner, reltuples, minrows, jsonout, tablematchnum, pg_table_size(reloid) as relsize, pg_stat_get_dead_tuples(reloid) as deadtuples, (select age(c.relfrozenxid) from pg_class c where c.oid = sub.reloid) as xidage, (select t.neveranalyzed from pg_temp.tables t where t.reloid = sub.reloid limit 1) as neveranalyzed, (select t.rowcountsource from pg_temp.tables t where t.reloid = sub.reloid limit 1) as rowcountsource from (select reloid, relnamespace, relname, owner, reltuples, minrows, relkind, tablematchnum, json_object_agg(parameter, json_build_object('oldsetting',oldsetting,'newsetting',newsetting)) as jsonout from effective_settings group by reloid, relnamespace, relname, owner, reltuples, minrows, relkind, tablematchnum order by relnamespace, relname, owner) sub`
 
+// display mode also returns the schema name, all current reloptions, and last autovacuum, for the match report
 const RuleMatchDisplayModeQuery string = `with rulematch as (select rs.ruleset, t.tablematchnum, rs.rulenum, t.reloid, t.relnamespace, t.relname, t.owner, t.reltuples, rs.minrows, t.relkind from pg_temp.tables t join pg_temp.rulesets rs on t.ruleset = rs.ruleset and case
 when t.reltuples >= rs.minrows then 't'::bool
 else 'f'::bool end),
@@ -44,4 +75,58 @@ effective_settings_sub1 as (select rm.tablematchnum, rm.rulenum, rm.reloid, rm.r
 effective_settings_sub2 as (select reloid, relnamespace, relname, owner, reltuples, minrows, relkind, tablematchnum, parameter, setting from effective_settings_sub1 where (tablematchnum, rulenum, reloid, relnamespace, relname, owner, parameter) in (select tablematchnum, max(rulenum) as rulenum, reloid, relnamespace, relname, owner, parameter from effective_settings_sub1 group by tablematchnum, reloid, relnamespace, relname, owner, parameter)),
 effective_settings as (select ess.reloid, ess.relnamespace, ess.relname, ess.owner, ess.reltuples, ess.minrows, ess.relkind, ess.tablematchnum, ess.parameter, tparams.setting as oldsetting, ess.setting as newsetting from effective_settings_sub2 ess left outer join tableparameters tparams on ess.reloid=tparams.reloid and ess.parameter=tparams.parameter),
 unmatched_tables as (select reloid, relkind, relnamespace, relname, owner, reltuples, tablematchnum from pg_temp.tables where reloid not in (select reloid from rulematch))
-select reloid::integer, relkind, format('%I.%I',relnamespace,relname) as quotedfullname, owner, reltuples, minrows, jsonout, tablematchnum from (select reloid, relkind, relnamespace, relname, owner, reltuples, minrows, jsonout, tablematchnum from (select reloid, relnamespace, relname, owner, reltuples, minrows, relkind, tablematchnum, json_object_agg(parameter, json_build_object('oldsetting',oldsetting,'newsetting',newsetting)) as jsonout from effective_settings group by reloid, relnamespace, relname, owner, reltuples, minrows, relkind, tablematchnum union all select reloid, relnamespace, relname, owner, reltuples, null, relkind, tablematchnum, '{}'::json from unmatched_tables) sub1) sub2 order by relnamespace, relname, owner`
+select reloid::integer, relkind, format('%I.%I',relnamespace,relname) as quotedfullname, owner, reltuples, minrows, jsonout, tablematchnum, pg_table_size(reloid) as relsize, pg_stat_get_dead_tuples(reloid) as deadtuples, (select age(c.relfrozenxid) from pg_class c where c.oid = sub2.reloid) as xidage, (select t.neveranalyzed from pg_temp.tables t where t.reloid = sub2.reloid limit 1) as neveranalyzed, (select t.rowcountsource from pg_temp.tables t where t.reloid = sub2.reloid limit 1) as rowcountsource, (select n.nspname from pg_class c join pg_namespace n on n.oid = c.relnamespace where c.oid = sub2.reloid) as schemaname, (select coalesce(c.reloptions, '{}') from pg_class c where c.oid = sub2.reloid) as reloptions, pg_stat_get_last_autovacuum_time(reloid) as lastautovacuum from (select reloid, relkind, relnamespace, relname, owner, reltuples, minrows, jsonout, tablematchnum from (select reloid, relnamespace, relname, owner, reltuples, minrows, relkind, tablematchnum, json_object_agg(parameter, json_build_object('oldsetting',oldsetting,'newsetting',newsetting)) as jsonout from effective_settings group by reloid, relnamespace, relname, owner, reltuples, minrows, relkind, tablematchnum union all select reloid, relnamespace, relname, owner, reltuples, null, relkind, tablematchnum, '{}'::json from unmatched_tables) sub1) sub2 order by relnamespace, relname, owner`
+
+const RunLockTry string = `select pg_try_advisory_lock($1::integer, hashtext($2))`
+
+const RunLockWait string = `select true from (select pg_advisory_lock($1::integer, hashtext($2))) sub`
+
+const RunLockRelease string = `select pg_advisory_unlock($1::integer, hashtext($2))`
+
+const RelationParametersQuery string = `select c.oid::integer, format('%I.%I',c.relnamespace::regnamespace::text,c.relname) as quotedfullname, c.relkind, c.reltuples::float8, coalesce(c.reloptions, '{}') from pg_class c where c.oid = any($1::bigint[]::oid[])`
+
+const ExplainRelationQuery string = `select c.oid::integer, format('%I.%I',c.relnamespace::regnamespace::text,c.relname) as quotedfullname, c.relkind, c.relpersistence = 'p' as permanent, c.relnamespace::regnamespace::text as relnamespace, c.relname, c.relowner::regrole::text as owner, coalesce(c.reloptions, '{}') from pg_class c where c.oid = to_regclass($1)`
+
+// matches a name the way TablesTempTab does, given the name, the regular expression, and case sensitivity
+const ExplainRegexMatch string = `select case when $3 then $1 ~ $2 else $1 ~* $2 end`
+
+const InRecovery string = `select pg_is_in_recovery()`
+
+const ValidateRegex string = `select '' ~ $1`
+
+const ValidateSize string = `select pg_size_bytes($1)`
+
+// history queries are templates - %[1]s is the quoted history schema name
+
+const HistorySchemaCreate string = `create schema if not exists %[1]s`
+
+const HistoryVersionCreate string = `create table if not exists %[1]s.schema_version (version integer not null)`
+
+const HistoryVersionLock string = `lock table %[1]s.schema_version in exclusive mode`
+
+const HistoryVersionQuery string = `select coalesce(max(version), 0) from %[1]s.schema_version`
+
+const HistoryVersionUpdate string = `with del as (delete from %[1]s.schema_version) insert into %[1]s.schema_version (version) values ($1)`
+
+// each entry upgrades the history schema by one version, so never change one that has been released - add another
+var HistoryMigrations = []string{
+	`create table %[1]s.runs (run_id text primary key, started_at timestamptz not null, finished_at timestamptz not null default now(), database_user text not null default current_user, mode text not null, tables_matched integer not null, mviews_matched integer not null, parameters_matched integer not null, parameters_attempted integer not null, parameters_set integer not null, parameters_errored integer not null, tables_skipped_locked integer not null, exit_code integer not null);
+create table %[1]s.parameter_history (id bigint generated always as identity primary key, run_id text not null, changed_at timestamptz not null default now(), database_user text not null default current_user, reloid oid not null, table_name text not null, relkind "char" not null, reltuples bigint not null, matchgroup integer, ruleset text, minrows bigint, parameter text not null, old_setting text, new_setting text);
+create index parameter_history_table_idx on %[1]s.parameter_history (table_name, changed_at);
+create index parameter_history_run_idx on %[1]s.parameter_history (run_id)`,
+	`create table %[1]s.pins (reloid oid not null, parameter text not null, table_name text not null, setting text, pinned_at timestamptz not null default now(), database_user text not null default current_user, run_id text, primary key (reloid, parameter));
+create index parameter_history_reloid_idx on %[1]s.parameter_history (reloid, parameter, id);
+alter table %[1]s.runs add column parameters_drifted integer not null default 0`,
+}
+
+const HistoryCheck string = `select to_regclass($1) is not null and to_regclass($2) is not null`
+
+const HistoryParameterInsert string = `insert into %[1]s.parameter_history (run_id, reloid, table_name, relkind, reltuples, matchgroup, ruleset, minrows, parameter, old_setting, new_setting) values ($1, $2::bigint::oid, $3, $4::text::"char", $5, $6, $7, $8, $9, $10, $11)`
+
+const HistoryRunInsert string = `insert into %[1]s.runs (run_id, started_at, mode, tables_matched, mviews_matched, parameters_matched, parameters_attempted, parameters_set, parameters_errored, tables_skipped_locked, parameters_drifted, exit_code) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
+
+const HistoryLastAppliedQuery string = `select distinct on (reloid, parameter) reloid::bigint, parameter, new_setting, matchgroup is not null as fromrule from %[1]s.parameter_history where reloid = any($1::bigint[]::oid[]) order by reloid, parameter, id desc`
+
+const HistoryPinsQuery string = `select reloid::bigint, parameter from %[1]s.pins where reloid = any($1::bigint[]::oid[])`
+
+const HistoryPinInsert string = `insert into %[1]s.pins (reloid, parameter, table_name, setting, run_id) values ($1::bigint::oid, $2, $3, $4, $5) on conflict do nothing`
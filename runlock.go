@@ -0,0 +1,126 @@
+// Copyright (c) 2022 James Lucas
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// advisory lock class id used for run locks ("pgst"), to stay clear of application advisory locks
+const RunLockClassID int32 = 0x70677374
+
+// returned by Acquire and Ensure once the lock has been released, including when Release interrupts them
+var ErrRunLockReleased = errors.New("run lock has been released")
+
+/*
+	Lock preventing concurrent pgstratify runs against the same database.
+	It's held on its own connection, so it can be released from a signal
+	handler without interfering with the connections doing the work.
+*/
+type RunLock struct {
+	db        *DBInterface
+	name      string
+	ctx       context.Context
+	cancel    context.CancelFunc
+	mutex     sync.Mutex
+	acquiring sync.WaitGroup // Acquire calls still using the connection, which Release has to wait for
+	held      bool
+	closed    bool
+}
+
+// construct a RunLock on the given connection - the RunLock takes ownership of the connection
+func NewRunLock(db *DBInterface, name string) *RunLock {
+	ctx, cancel := context.WithCancel(bgctx)
+	return &RunLock{db: db, name: name, ctx: ctx, cancel: cancel}
+}
+
+// try to take the lock, waiting for any other run to finish if wait is set
+// returns false if another run holds the lock
+// if Release interrupts the wait, returns ErrRunLockReleased
+func (rl *RunLock) Acquire(wait bool) (bool, error) {
+	/*
+		A blocking acquire can't hold the mutex, or Release couldn't get in to interrupt it.
+		Instead it's counted in acquiring, and Release waits for it to return before closing
+		the connection - pgx connections can't be used by two goroutines at once.
+	*/
+	rl.mutex.Lock()
+	if rl.closed {
+		rl.mutex.Unlock()
+		return false, ErrRunLockReleased
+	}
+	rl.acquiring.Add(1)
+	rl.mutex.Unlock()
+	defer rl.acquiring.Done()
+
+	acquired, err := rl.db.AdvisoryLock(rl.ctx, RunLockClassID, rl.name, wait)
+	if err != nil {
+		if rl.ctx.Err() != nil {
+			return false, ErrRunLockReleased
+		}
+		return false, err
+	}
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.held = acquired
+	return acquired, nil
+}
+
+/*
+	Make sure we still hold the lock, for long-running daemons. If the lock's connection
+	dropped, the server released the lock, so reconnect and try to take it again (without
+	waiting). Returns false if another run got it first.
+*/
+func (rl *RunLock) Ensure() (bool, error) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if rl.closed {
+		return false, ErrRunLockReleased
+	}
+	if rl.held && rl.db.Ping() == nil {
+		return true, nil
+	}
+
+	log.Warn("Lost run lock connection, reconnecting")
+	rl.held = false
+	err := rl.db.Reconnect()
+	if err != nil {
+		return false, err
+	}
+	acquired, err := rl.db.AdvisoryLock(rl.ctx, RunLockClassID, rl.name, false)
+	if err != nil {
+		return false, err
+	}
+	rl.held = acquired
+	return acquired, nil
+}
+
+// release the lock (if held) and close its connection
+// safe to call more than once, and while Acquire is still waiting
+func (rl *RunLock) Release() {
+	// interrupt Acquire if it's still waiting, and wait for it to let go of the connection
+	rl.cancel()
+	rl.mutex.Lock()
+	if rl.closed {
+		rl.mutex.Unlock()
+		return
+	}
+	rl.closed = true
+	rl.mutex.Unlock()
+	rl.acquiring.Wait()
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if rl.held {
+		err := rl.db.AdvisoryUnlock(RunLockClassID, rl.name)
+		if err != nil {
+			// closing the connection releases it anyway
+			log.Warn(err)
+		}
+		rl.held = false
+	}
+	rl.db.Close()
+}
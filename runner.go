@@ -0,0 +1,369 @@
+// Copyright (c) 2022 James Lucas
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// settings controlling how tables that cannot be locked are retried
+type LockRetryOptions struct {
+	NowaitPasses    int     // number of opportunistic nowait passes before the wait pass
+	PassLockTimeout float64 // lock timeout in seconds for each statement during nowait passes
+	RetryDelay      float64 // delay in seconds before the second nowait pass, doubled for each pass after
+	MaxRetryDelay   float64 // upper bound in seconds on the delay between nowait passes
+	WaitTimeout     float64 // per-table timeout in seconds for the wait pass (-1 to wait forever)
+	SkipLocked      bool    // skip the wait pass entirely, and report tables still locked after the nowait passes
+	ErrorRetries    int     // number of times to retry a table after a retriable error or reconnect
+}
+
+// random numbers for retry and schedule jitter, and run ids
+// a rand.Rand isn't safe for concurrent use, and workers jitter their retries at the same time, so this one has a lock
+type lockedRand struct {
+	rng   *rand.Rand
+	mutex sync.Mutex
+}
+
+var jitterRand = &lockedRand{rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+func (lr *lockedRand) Float64() float64 {
+	lr.mutex.Lock()
+	defer lr.mutex.Unlock()
+	return lr.rng.Float64()
+}
+
+func (lr *lockedRand) Int63n(n int64) int64 {
+	lr.mutex.Lock()
+	defer lr.mutex.Unlock()
+	return lr.rng.Int63n(n)
+}
+
+func (lr *lockedRand) Uint32() uint32 {
+	lr.mutex.Lock()
+	defer lr.mutex.Unlock()
+	return lr.rng.Uint32()
+}
+
+// a table waiting to be processed, along with the number of attempts made so far
+type QueuedMatch struct {
+	Match    TableMatch
+	Attempts int
+}
+
+// applies parameter changes to a list of tables, spread across a set of connections
+type Runner struct {
+	Connections []*DBInterface
+	DryRun      bool
+	AlterMode   int
+	Retry       LockRetryOptions
+	Stats       *RunStats
+	Output      OutputWriter
+	Undo        *UndoLog       // if set, successful changes are recorded here
+	History     *HistoryTarget // if set, changes are also recorded in the database
+	Metrics     *Metrics       // if set, lock wait times are recorded here
+	// mutex for synchronizing multi-line output - it's not worth juggling more channels for this
+	// log is already threadsafe - this is just to keep goroutines from interleaving output lines
+	outmutex sync.Mutex
+	// the error that stopped the run, if any - workers stop taking tables once it's set
+	err      error
+	errmutex sync.Mutex
+}
+
+// record an error that stops the run - only the first is kept
+func (r *Runner) fail(err error) {
+	r.errmutex.Lock()
+	defer r.errmutex.Unlock()
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// the error that stopped the run, nil if nothing has
+func (r *Runner) failure() error {
+	r.errmutex.Lock()
+	defer r.errmutex.Unlock()
+	return r.err
+}
+
+// delay before the given nowait pass (numbered from 1), with exponential backoff and jitter
+func (r *Runner) passDelay(pass int) time.Duration {
+	if pass < 2 || r.Retry.RetryDelay <= 0 {
+		return 0
+	}
+	delay := math.Min(r.Retry.RetryDelay*math.Pow(2, float64(pass-2)), r.Retry.MaxRetryDelay)
+	// jitter by up to 50% either way, so parallel runs don't retry in lockstep
+	delay = delay * (0.5 + jitterRand.Float64())
+	return time.Duration(delay * float64(time.Second))
+}
+
+/*
+	Apply parameter changes to all the given tables.
+
+	We make one or more opportunistic passes through the tables and try to set
+	parameters in nowait mode. Hopefully this knocks out the majority of
+	the tables near the start of the run. Tables that fail to lock are retried
+	in later passes, with a backoff delay in between, and then finally in wait mode
+	(unless we are in skip-locked mode).
+	We suppress output of anything that failed to lock during a nowait pass
+	unless it will not be retried.
+
+	An error that can't be dealt with table by table (the connection can't be
+	re-established, or something unexpected) stops the run and is returned.
+	Changes made before then are still recorded in the stats, output, and undo log.
+*/
+func (r *Runner) Apply(tablematches []TableMatch) error {
+	pending := make([]QueuedMatch, 0, len(tablematches))
+	for _, val := range tablematches {
+		pending = append(pending, QueuedMatch{Match: val})
+	}
+
+	passes := r.Retry.NowaitPasses
+	if passes < 1 {
+		passes = 1
+	}
+	for pass := 1; pass <= passes && len(pending) > 0 && r.failure() == nil; pass++ {
+		if delay := r.passDelay(pass); delay > 0 {
+			log.Debugf("Retrying %d locked tables in %.1f seconds (pass %d of %d)", len(pending), delay.Seconds(), pass, passes)
+			time.Sleep(delay)
+		}
+		// lock failures are only final on the last nowait pass in skip-locked mode
+		pending = r.runPass(pending, WaitModeNowait, r.Retry.PassLockTimeout, r.Retry.SkipLocked && pass == passes)
+	}
+
+	// whatever is left gets a pass in wait mode
+	if len(pending) > 0 && r.failure() == nil {
+		r.runPass(pending, WaitModeWait, r.Retry.WaitTimeout, true)
+	}
+	return r.failure()
+}
+
+/*
+	Launch a goroutine for each connection (up to the number of tables), each reading tables from
+	a shared iterator. Tables that fail to lock are returned for retry, unless final is set, in which
+	case the failure is reported (other errors are handled by updateTableClassified). Once the run
+	has failed, the remaining tables are passed over.
+*/
+func (r *Runner) runPass(pending []QueuedMatch, waitmode int, timeout float64, final bool) []QueuedMatch {
+	// goroutine iterating over pending tables and returning them on a channel
+	matchiter := make(chan QueuedMatch)
+	go func(matchiter chan<- QueuedMatch) {
+		for _, v := range pending {
+			matchiter <- v
+		}
+		close(matchiter)
+	}(matchiter)
+
+	// goroutine receiving failed tables from workers
+	lockpendingrcv := make(chan QueuedMatch)
+	lockpendingret := make(chan []QueuedMatch)
+	go func(matchin <-chan QueuedMatch, matchesout chan<- []QueuedMatch) {
+		lockpending := make([]QueuedMatch, 0)
+		for m := range matchin {
+			lockpending = append(lockpending, m)
+		}
+		matchesout <- lockpending
+	}(lockpendingrcv, lockpendingret)
+
+	connections := r.Connections
+	if len(pending) < len(connections) {
+		connections = connections[:len(pending)]
+	}
+
+	// when matchiter is closed, each worker closes its donechan to signal it is complete
+	donechans := make([]chan bool, 0, len(connections))
+	for idx, val := range connections {
+		donechan := make(chan bool)
+		donechans = append(donechans, donechan)
+		go func(worker int, conn *DBInterface, donechan chan<- bool) {
+			for q := range matchiter {
+				// keep draining the iterator, so it can finish
+				if r.failure() != nil {
+					continue
+				}
+				q.Attempts++
+				tlog := log.WithFields(log.Fields{"table": q.Match.QuotedFullName, "worker": worker})
+				rslt, err := r.updateTableClassified(conn, q.Match, waitmode, timeout, tlog)
+				rslt.Attempts = q.Attempts
+				rslt.Worker = worker
+				if err != nil {
+					var alerr *AcquireLockError
+					if errors.As(err, &alerr) {
+						if final {
+							r.outmutex.Lock()
+							// we need to output even on lock failure
+							r.Output.LockSkipped(&rslt, err, waitmode)
+							r.outmutex.Unlock()
+							r.Stats.RecordLockSkip()
+						} else {
+							lockpendingrcv <- q
+						}
+					} else {
+						r.fail(err)
+						continue
+					}
+				} else {
+					r.outmutex.Lock()
+					r.Output.Result(&rslt)
+					r.outmutex.Unlock()
+					if r.Undo != nil {
+						r.Undo.Record(&rslt)
+					}
+				}
+				// record result stats - mutex synchronized internally
+				r.Stats.UpdateFromResult(&rslt)
+			}
+			close(donechan)
+		}(idx, val, donechan)
+	}
+
+	// wait until all donechans are closed
+	for _, donechan := range donechans {
+		<-donechan
+	}
+
+	// close lockpendingrcv, then retrieve lockpending
+	close(lockpendingrcv)
+	lockpending := <-lockpendingret
+	close(lockpendingret)
+	return lockpending
+}
+
+/*
+	Update a single table, dealing with any errors other than lock failures according to
+	their class. Retriable errors are retried (after reconnecting, if the connection was
+	lost), and if they keep happening the table is recorded as failed. Per-table errors are
+	recorded against each parameter of the table. Lock failures are returned as they are.
+	Anything else - including running out of reconnect attempts, or being unable to
+	reconnect - is returned to stop the run. Messages go to tlog, which carries the table
+	and worker as fields.
+*/
+func (r *Runner) updateTableClassified(conn *DBInterface, m TableMatch, waitmode int, timeout float64, tlog *log.Entry) (UpdateTableParametersResult, error) {
+	for tries := 0; ; tries++ {
+		rslt, err := r.updateTable(conn, m, waitmode, timeout, tlog)
+		if err == nil {
+			return rslt, nil
+		}
+		var alerr *AcquireLockError
+		if errors.As(err, &alerr) {
+			return rslt, err
+		}
+
+		switch conn.ClassifyError(err) {
+		case ErrorClassRetriable:
+			if tries >= r.Retry.ErrorRetries {
+				tlog.Warnf("Giving up on %s after %d retries: %v", m.QuotedFullName, tries, err)
+				return TableFailureResult(m, err), nil
+			}
+			tlog.Warnf("Retrying %s after error: %v", m.QuotedFullName, err)
+			time.Sleep(r.passDelay(tries + 2))
+		case ErrorClassConnection:
+			if tries >= r.Retry.ErrorRetries {
+				return rslt, fmt.Errorf("lost database connection while updating %s: %w", m.QuotedFullName, err)
+			}
+			tlog.Warnf("Lost database connection while updating %s, reconnecting: %v", m.QuotedFullName, err)
+			time.Sleep(r.passDelay(tries + 2))
+			rcerr := conn.Reconnect()
+			if rcerr != nil {
+				return rslt, fmt.Errorf("unable to reconnect while updating %s: %w", m.QuotedFullName, rcerr)
+			}
+		case ErrorClassTable:
+			return TableFailureResult(m, err), nil
+		default:
+			return rslt, fmt.Errorf("updating %s: %w", m.QuotedFullName, err)
+		}
+	}
+}
+
+// update a single table, emitting a message if we end up waiting on a lock for more than a second
+func (r *Runner) updateTable(conn *DBInterface, m TableMatch, waitmode int, timeout float64, tlog *log.Entry) (UpdateTableParametersResult, error) {
+	if waitmode != WaitModeWait {
+		rslt, err := conn.UpdateTableParameters(m, r.DryRun, waitmode, timeout, r.AlterMode, r.History)
+		r.observeLockWait(waitmode, &rslt)
+		return rslt, err
+	}
+
+	waitctx, waitcancel := context.WithCancel(context.Background())
+	go func() {
+		timer := time.NewTimer(time.Second)
+		select {
+		case <-waitctx.Done():
+			// drain the channel, per the docs
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-timer.C:
+			tlog.Warnf("Waiting for lock on table %s", m.QuotedFullName)
+		}
+	}()
+	rslt, err := conn.UpdateTableParameters(m, r.DryRun, waitmode, timeout, r.AlterMode, r.History)
+	// cancel the wait - if the message fired already this does nothing
+	waitcancel()
+	r.observeLockWait(waitmode, &rslt)
+	return rslt, err
+}
+
+// record the time an attempt spent waiting for locks - dry runs don't take any
+func (r *Runner) observeLockWait(waitmode int, rslt *UpdateTableParametersResult) {
+	if r.Metrics != nil && !r.DryRun {
+		r.Metrics.ObserveLockWait(waitmode, rslt.LockWait)
+	}
+}
+
+// analyze relations across the connection pool, warning about (but otherwise ignoring) failures
+// only losing a connection that can't be re-established stops it, and that error is returned
+func (r *Runner) Analyze(rels []MatchedRelation, timeout float64) error {
+	// goroutine iterating over relations and returning them on a channel
+	reliter := make(chan MatchedRelation)
+	go func(reliter chan<- MatchedRelation) {
+		for _, v := range rels {
+			reliter <- v
+		}
+		close(reliter)
+	}(reliter)
+
+	connections := r.Connections
+	if len(rels) < len(connections) {
+		connections = connections[:len(rels)]
+	}
+
+	donechans := make([]chan bool, 0, len(connections))
+	for idx, val := range connections {
+		donechan := make(chan bool)
+		donechans = append(donechans, donechan)
+		go func(worker int, conn *DBInterface, donechan chan<- bool) {
+			for rel := range reliter {
+				// keep draining the iterator, so it can finish
+				if r.failure() != nil {
+					continue
+				}
+				tlog := log.WithFields(log.Fields{"table": rel.QuotedFullName, "worker": worker})
+				tlog.Debugf("Analyzing %s", rel.QuotedFullName)
+				err := conn.AnalyzeRelation(rel, timeout)
+				if err != nil {
+					tlog.Warnf("Unable to analyze %s: %v", rel.QuotedFullName, err)
+					if conn.ClassifyError(err) == ErrorClassConnection {
+						rcerr := conn.Reconnect()
+						if rcerr != nil {
+							r.fail(fmt.Errorf("unable to reconnect after analyzing %s: %w", rel.QuotedFullName, rcerr))
+						}
+					}
+				}
+			}
+			close(donechan)
+		}(idx, val, donechan)
+	}
+
+	// wait until all donechans are closed
+	for _, donechan := range donechans {
+		<-donechan
+	}
+	return r.failure()
+}
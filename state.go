@@ -0,0 +1,103 @@
+// Copyright (c) 2022 James Lucas
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// what we knew about a relation the last time it was evaluated
+type RelationState struct {
+	Reltuples      float64 `json:"reltuples"` // pg_class.reltuples
+	Rowcount       float64 `json:"rowcount"`  // the rowcount the rules were evaluated against
+	RowcountSource string  `json:"rowcount_source"`
+	Relfilenode    int64   `json:"relfilenode"`
+	Owner          string  `json:"owner"`
+	Matchgroup     int     `json:"matchgroup"`
+	Minrows        *int64  `json:"minrows"` // band applied, nil if no rule matched
+}
+
+/*
+	State persisted between runs, so later runs only need to evaluate relations
+	that changed. State is only valid for the database and rules it was built with.
+*/
+type StateFile struct {
+	Database   string                `json:"database"`
+	ConfigHash string                `json:"config_hash"`
+	Relations  map[int]RelationState `json:"relations"`
+}
+
+// relations evaluated (or skipped as unchanged) by GetTableMatches, for incremental runs
+type EvaluationState struct {
+	Known     map[int]RelationState // input: relations that can be skipped if they haven't changed
+	Evaluated map[int]RelationState // output: relations that were evaluated this time
+	Unchanged []int                 // output: known relations that were skipped
+}
+
+// hash identifying a set of rules - if it changes, all the saved state is stale
+func ConfigHash(config *ConfigFile) (string, error) {
+	// json output is deterministic (map keys are sorted), unlike iterating the maps ourselves
+	buf, err := json.Marshal(config)
+	if err != nil {
+		return *new(string), err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(buf)), nil
+}
+
+// read a state file - a missing file is not an error, it just means we have no state yet
+func ReadStateFile(filename string) (*StateFile, error) {
+	sf := StateFile{Relations: make(map[int]RelationState)}
+	dat, err := os.ReadFile(filename)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &sf, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(dat, &sf)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse state file %s: %w", filename, err)
+	}
+	if sf.Relations == nil {
+		sf.Relations = make(map[int]RelationState)
+	}
+	return &sf, nil
+}
+
+// write the state file, replacing any previous one atomically so a crash can't leave it half-written
+func (sf *StateFile) Write(filename string) error {
+	buf, err := json.Marshal(sf)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, buf, 0600)
+}
+
+// write a file via a temp file and rename, so nothing ever sees it half written
+// the temp file is created private, so it gets the given mode before anything is written
+func writeFileAtomic(filename string, buf []byte, mode fs.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	err = tmp.Chmod(mode)
+	if err == nil {
+		_, err = tmp.Write(buf)
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
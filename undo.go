@@ -0,0 +1,220 @@
+// Copyright (c) 2022 James Lucas
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// prefix of the comment line describing each table in an undo file
+const undoTablePrefix = "-- pgstratify-undo: "
+
+// a table's parameters to put back, as recorded in an undo file
+type UndoTable struct {
+	Reloid         int                     `json:"reloid"`
+	Relkind        string                  `json:"relkind"`
+	QuotedFullName string                  `json:"table"`
+	Parameters     map[string]UndoSettings `json:"parameters"`
+}
+
+// a parameter setting to put back (Restore), and what it was set to (Applied), nil meaning unset
+type UndoSettings struct {
+	Restore *string `json:"restore"`
+	Applied *string `json:"applied"`
+}
+
+/*
+	Records the parameters that were successfully changed during a run in an undo file.
+	Each table is appended as soon as its changes are committed, so the file covers
+	everything changed so far even if the run is interrupted or killed. The file is only
+	created once there's something to put in it. Results come from the worker goroutines,
+	so access is synchronized.
+
+	The file is a psql script, so it can be reviewed and run by hand, but each table is
+	preceded by a comment holding the same information as json, which is what the undo
+	command reads.
+*/
+type UndoLog struct {
+	dir      string
+	dbname   string
+	runid    string
+	filename string
+	file     *os.File
+	err      error // the first write error, returned by Close
+	mutex    sync.Mutex
+}
+
+// construct an UndoLog writing into dir, naming its file for the database, time, and run id
+func NewUndoLog(dir string, dbname string, runid string) *UndoLog {
+	return &UndoLog{dir: dir, dbname: dbname, runid: runid}
+}
+
+// append the successfully set parameters from a result to the undo file
+func (ul *UndoLog) Record(rslt *UpdateTableParametersResult) {
+	ut := UndoTable{Reloid: rslt.Match.Reloid, Relkind: string(rslt.Match.Relkind), QuotedFullName: rslt.Match.QuotedFullName, Parameters: make(map[string]UndoSettings)}
+	for _, val := range rslt.SettingSuccess {
+		if val.Success {
+			param := rslt.Match.Parameters[val.Setting]
+			ut.Parameters[val.Setting] = UndoSettings{Restore: param.OldSetting, Applied: param.NewSetting}
+		}
+	}
+	if len(ut.Parameters) == 0 {
+		return
+	}
+	ul.mutex.Lock()
+	defer ul.mutex.Unlock()
+	if ul.err != nil {
+		return
+	}
+	if ul.file == nil {
+		ul.err = ul.create()
+		if ul.err != nil {
+			log.Errorf("Unable to write undo file: %v", ul.err)
+			return
+		}
+	}
+	// one write per table, so an interrupted run leaves only whole tables behind
+	var buf []byte
+	buf, ul.err = ut.undoScript()
+	if ul.err == nil {
+		ul.err = ul.write(buf)
+	}
+	if ul.err != nil {
+		log.Errorf("Unable to write undo file %s: %v", ul.filename, ul.err)
+	}
+}
+
+// create the undo file and write its header
+func (ul *UndoLog) create() error {
+	now := time.Now()
+	safename := regexp.MustCompile(`[^A-Za-z0-9_.-]`).ReplaceAllString(ul.dbname, "_")
+	filename := filepath.Join(ul.dir, fmt.Sprintf("pgstratify-undo-%s-%s-%s.sql", safename, now.UTC().Format("20060102T150405Z"), ul.runid))
+	err := os.MkdirAll(ul.dir, 0700)
+	if err != nil {
+		return err
+	}
+	ul.file, err = os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	ul.filename = filename
+	log.Infof("Writing undo file %s", filename)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "-- pgstratify %s undo script for database %s, run %s, generated %s\n", Version, commentSafe(ul.dbname), ul.runid, now.Format(time.RFC3339))
+	fmt.Fprintf(&buf, "-- apply with: pgstratify undo %s\n", commentSafe(filename))
+	return ul.write(buf.Bytes())
+}
+
+// append to the undo file
+func (ul *UndoLog) write(buf []byte) error {
+	_, err := ul.file.Write(buf)
+	return err
+}
+
+// close the undo file, returning its name ("" if nothing was changed) and any error writing it
+func (ul *UndoLog) Close() (string, error) {
+	ul.mutex.Lock()
+	defer ul.mutex.Unlock()
+	if ul.file == nil {
+		return ul.filename, ul.err
+	}
+	err := ul.file.Close()
+	ul.file = nil
+	if ul.err == nil {
+		ul.err = err
+	}
+	return ul.filename, ul.err
+}
+
+// the undo file section for a table - its json comment and the statement putting it back
+func (ut *UndoTable) undoScript() ([]byte, error) {
+	header, err := json.Marshal(ut)
+	if err != nil {
+		return nil, err
+	}
+	tm := ut.TableMatch()
+	altersql, err := tm.AlterSQL(tm.SortedParameters())
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("\n%s%s\nbegin;\n%s;\ncommit;\n", undoTablePrefix, header, altersql)), nil
+}
+
+// where undo files go without --undo-dir: pgstratify/undo under $XDG_STATE_HOME, or ~/.local/state if that isn't set
+func DefaultUndoDir() (string, error) {
+	statedir := os.Getenv("XDG_STATE_HOME")
+	if statedir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("unable to find a directory for undo files, use --undo-dir: %w", err)
+		}
+		statedir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(statedir, "pgstratify", "undo"), nil
+}
+
+// the TableMatch that would put the table back, assuming its parameters are still as we left them
+func (ut *UndoTable) TableMatch() TableMatch {
+	tm := TableMatch{Reloid: ut.Reloid, QuotedFullName: ut.QuotedFullName, Matchgroup: new(ConfigMatchgroup), RowcountSource: "reltuples", Parameters: make(map[string]TableMatchParameter)}
+	if len(ut.Relkind) > 0 {
+		tm.Relkind = rune(ut.Relkind[0])
+	}
+	for key, val := range ut.Parameters {
+		tm.Parameters[key] = TableMatchParameter{OldSetting: val.Applied, NewSetting: val.Restore}
+	}
+	return tm
+}
+
+// read the tables recorded in an undo file
+func ReadUndoFile(filename string) ([]UndoTable, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tables := make([]UndoTable, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	linenum := 0
+	for scanner.Scan() {
+		linenum++
+		line := scanner.Text()
+		if !strings.HasPrefix(line, undoTablePrefix) {
+			continue
+		}
+		var ut UndoTable
+		err := json.Unmarshal([]byte(strings.TrimPrefix(line, undoTablePrefix)), &ut)
+		if err != nil {
+			return nil, fmt.Errorf("invalid table entry at line %d of %s: %w", linenum, filename, err)
+		}
+		tables = append(tables, ut)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("%s is not a pgstratify undo file, or has no tables in it", filename)
+	}
+	return tables, nil
+}
+
+// whether two parameter settings are the same, nil meaning unset
+func settingsEqual(a *string, b *string) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}